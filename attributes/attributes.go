@@ -0,0 +1,169 @@
+// Package attributes defines the attributes of the addresses read by the
+// balancers of grpclb. They are kept in resolver.Address.Attributes, so any
+// resolver could set them, not only the consul one.
+package attributes
+
+import (
+	"google.golang.org/grpc/resolver"
+)
+
+// Key is the type of the keys of the attributes.
+type Key string
+
+// The keys of the attributes in resolver.Address.Attributes.
+const (
+	// KeyWeight is the weight of the address, an int greater than 0.
+	KeyWeight = Key("grpclb.weight")
+	// KeyHash is the key of the address hashed on the ring of ketama, a
+	// string which should be stable across the restarts of the instance.
+	KeyHash = Key("grpclb.hash")
+	// KeyZone is the zone (or region, data center) of the address, a string.
+	KeyZone = Key("grpclb.zone")
+	// KeyRegion is the region of the address, which groups the zones, a
+	// string.
+	KeyRegion = Key("grpclb.region")
+	// KeyVersion is the version of the instance behind the address, a string.
+	KeyVersion = Key("grpclb.version")
+	// KeyTags is the tags of the instance behind the address, a []string.
+	KeyTags = Key("grpclb.tags")
+	// KeyMeta is the metadata of the instance behind the address, such as
+	// the Meta of a consul service, a map[string]string.
+	KeyMeta = Key("grpclb.meta")
+)
+
+// withValue returns a copy of addr with the attribute of key set to value.
+func withValue(addr resolver.Address, key Key, value interface{}) resolver.Address {
+	addr.Attributes = addr.Attributes.WithValue(key, value)
+	return addr
+}
+
+// WithWeight returns a copy of addr with the weight, which is ignored if it
+// is not greater than 0.
+func WithWeight(addr resolver.Address, weight int) resolver.Address {
+	if weight <= 0 {
+		return addr
+	}
+	return withValue(addr, KeyWeight, weight)
+}
+
+// Weight returns the weight of addr, or 1 if it has none.
+func Weight(addr resolver.Address) int {
+	if w, ok := addr.Attributes.Value(KeyWeight).(int); ok && w > 0 {
+		return w
+	}
+	return 1
+}
+
+// WithHashKey returns a copy of addr with the hash key.
+func WithHashKey(addr resolver.Address, key string) resolver.Address {
+	return withValue(addr, KeyHash, key)
+}
+
+// HashKey returns the hash key of addr, or addr.Addr if it has none.
+func HashKey(addr resolver.Address) string {
+	if key, ok := addr.Attributes.Value(KeyHash).(string); ok && len(key) > 0 {
+		return key
+	}
+	return addr.Addr
+}
+
+// WithZone returns a copy of addr with the zone.
+func WithZone(addr resolver.Address, zone string) resolver.Address {
+	return withValue(addr, KeyZone, zone)
+}
+
+// Zone returns the zone of addr, or "" if it has none.
+func Zone(addr resolver.Address) string {
+	return stringValue(addr, KeyZone)
+}
+
+// WithRegion returns a copy of addr with the region.
+func WithRegion(addr resolver.Address, region string) resolver.Address {
+	return withValue(addr, KeyRegion, region)
+}
+
+// Region returns the region of addr, or "" if it has none.
+func Region(addr resolver.Address) string {
+	return stringValue(addr, KeyRegion)
+}
+
+// WithVersion returns a copy of addr with the version.
+func WithVersion(addr resolver.Address, version string) resolver.Address {
+	return withValue(addr, KeyVersion, version)
+}
+
+// Version returns the version of addr, or "" if it has none.
+func Version(addr resolver.Address) string {
+	return stringValue(addr, KeyVersion)
+}
+
+// WithTags returns a copy of addr with the tags.
+func WithTags(addr resolver.Address, tags ...string) resolver.Address {
+	return withValue(addr, KeyTags, tagList(tags))
+}
+
+// Tags returns the tags of addr, or nil if it has none.
+func Tags(addr resolver.Address) []string {
+	t, _ := addr.Attributes.Value(KeyTags).(tagList)
+	return t
+}
+
+// HasTag reports whether addr has the tag.
+func HasTag(addr resolver.Address, tag string) bool {
+	for _, t := range Tags(addr) {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// tagList is the value of KeyTags, the attributes compare it by Equal as
+// a slice is not comparable.
+type tagList []string
+
+func (t tagList) Equal(o interface{}) bool {
+	ot, ok := o.(tagList)
+	if !ok || len(t) != len(ot) {
+		return false
+	}
+	for i := range t {
+		if t[i] != ot[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// WithMeta returns a copy of addr with the metadata.
+func WithMeta(addr resolver.Address, meta map[string]string) resolver.Address {
+	return withValue(addr, KeyMeta, metaMap(meta))
+}
+
+// Meta returns the metadata of addr, or nil if it has none.
+func Meta(addr resolver.Address) map[string]string {
+	m, _ := addr.Attributes.Value(KeyMeta).(metaMap)
+	return m
+}
+
+// metaMap is the value of KeyMeta, the attributes compare it by Equal as a
+// map is not comparable.
+type metaMap map[string]string
+
+func (m metaMap) Equal(o interface{}) bool {
+	om, ok := o.(metaMap)
+	if !ok || len(m) != len(om) {
+		return false
+	}
+	for k, v := range m {
+		if ov, ok := om[k]; !ok || ov != v {
+			return false
+		}
+	}
+	return true
+}
+
+func stringValue(addr resolver.Address, key Key) string {
+	s, _ := addr.Attributes.Value(key).(string)
+	return s
+}
@@ -0,0 +1,37 @@
+package ewma
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc/serviceconfig"
+
+	"github.com/dodoZeng/grpclb/balancer/internal/latency"
+)
+
+// lbConfig is the config of the ewma balancer in the service config, such as
+// {"loadBalancingConfig": [{"ewma": {"decay": "10s"}}]}
+type lbConfig struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+
+	// Decay is the time in which the latency of a SubConn decays, 10s by
+	// default. The longer it is, the slower the balancer reacts to a faster
+	// SubConn.
+	Decay string `json:"decay,omitempty"`
+
+	decay time.Duration
+}
+
+func parseConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	var c lbConfig
+	if err := json.Unmarshal(js, &c); err != nil {
+		return nil, fmt.Errorf("ewma: unable to unmarshal config %s: %v", js, err)
+	}
+	d, err := latency.ParseDecay(c.Decay)
+	if err != nil {
+		return nil, fmt.Errorf("ewma: %v", err)
+	}
+	c.decay = d
+	return &c, nil
+}
@@ -0,0 +1,98 @@
+// Package ewma defines a peak EWMA balancer, which picks the SubConn with the
+// lowest expected cost, the peak-sensitive EWMA of its latency times its
+// outstanding requests, as Finagle and Linkerd do. ewma balancer is
+// registered when this package is imported.
+package ewma
+
+import (
+	"math/rand"
+	"time"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/serviceconfig"
+
+	"github.com/dodoZeng/grpclb/balancer/internal/configbase"
+	"github.com/dodoZeng/grpclb/balancer/internal/latency"
+	"github.com/dodoZeng/grpclb/logging"
+)
+
+// BalancerName is the name of ewma balancer.
+const BalancerName = "ewma"
+
+var logger = logging.Component(BalancerName)
+
+// newBuilder creates a new ewma balancer builder.
+func newBuilder() balancer.Builder {
+	return configbase.NewBalancerBuilder(BalancerName, func() configbase.PickerBuilder {
+		return &ePickerBuilder{decay: latency.DefaultDecay}
+	}, parseConfig)
+}
+
+func init() {
+	balancer.Register(newBuilder())
+}
+
+type ePickerBuilder struct {
+	decay time.Duration
+
+	// stats is the latency of each SubConn, shared by the pickers of the
+	// balancer.
+	stats latency.Map
+}
+
+func (b *ePickerBuilder) UpdateConfig(config serviceconfig.LoadBalancingConfig) {
+	if c, ok := config.(*lbConfig); ok {
+		b.decay = c.decay
+	}
+}
+
+func (b *ePickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	readySCs := info.ReadySCs
+	if logger.V(1) {
+		logger.Infof("ewmaPicker: newPicker called with readySCs: %v", readySCs)
+	}
+
+	p := &ePicker{decay: b.decay}
+	p.subConns, p.stats = b.stats.Update(readySCs)
+	return p
+}
+
+type ePicker struct {
+	// subConns is the snapshot of the ewma balancer when this picker was
+	// created. The slice is immutable. stats[i] is the latency of
+	// subConns[i].
+	subConns []balancer.SubConn
+	stats    []*latency.Stats
+	decay    time.Duration
+}
+
+func (p *ePicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	n := len(p.subConns)
+	if n <= 0 {
+		return balancer.PickResult{}, balancer.ErrNoSubConnAvailable
+	}
+
+	// start from a random SubConn, so that the ties are not always broken
+	// in favor of the first one
+	now := time.Now()
+	best, bestCost := -1, 0.0
+	for k, off := 0, rand.Intn(n); k < n; k++ {
+		i := (off + k) % n
+		if c := p.stats[i].Cost(p.decay, now); best < 0 || c < bestCost {
+			best, bestCost = i, c
+		}
+	}
+	if logger.V(2) {
+		logger.Infof("ewmaPicker: picked SubConn %d of %d with cost %v", best, n, time.Duration(bestCost))
+	}
+
+	s := p.stats[best]
+	s.Start()
+	return balancer.PickResult{
+		SubConn: p.subConns[best],
+		Done: func(di balancer.DoneInfo) {
+			s.Done(now, di.Err, p.decay)
+		},
+	}, nil
+}
@@ -0,0 +1,40 @@
+package ewma
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/dodoZeng/grpclb/balancer/internal/testutil"
+)
+
+func TestAvoidSlowBackend(t *testing.T) {
+	fast := &testutil.Backend{Addr: "fast"}
+	slow := &testutil.Backend{Addr: "slow", Delay: 20 * time.Millisecond}
+	// a short decay, so that a scheduling blip of fast is forgotten soon
+	cc := testutil.Dial(t, `{"ewma": {"decay": "100ms"}}`, fast, slow)
+	testutil.WarmUp(t, cc, fast, slow)
+
+	n := slow.Calls()
+	testutil.Call(cc, 100)
+	if n = slow.Calls() - n; n > 10 {
+		t.Errorf("slow backend got %d of 100 requests", n)
+	}
+}
+
+func TestAvoidFailingBackend(t *testing.T) {
+	ok := &testutil.Backend{Addr: "ok", Delay: 2 * time.Millisecond}
+	failing := &testutil.Backend{Addr: "failing", Err: status.Error(codes.Unavailable, "down")}
+	cc := testutil.Dial(t, `{"ewma": {}}`, ok, failing)
+	testutil.WarmUp(t, cc, ok, failing)
+
+	// the failing backend answers faster, but its requests count as the
+	// penalty latency
+	n := failing.Calls()
+	testutil.Call(cc, 100)
+	if n = failing.Calls() - n; n > 10 {
+		t.Errorf("failing backend got %d of 100 requests", n)
+	}
+}
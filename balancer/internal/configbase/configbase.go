@@ -0,0 +1,132 @@
+// Package configbase defines a base balancer whose picker builder receives
+// the load balancing config in the service config, which the base balancer
+// of gRPC ignores.
+package configbase
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// PickerBuilder creates pickers with the config of its balancer.
+type PickerBuilder interface {
+	base.PickerBuilder
+	// UpdateConfig is called with the parsed config before the pickers are
+	// built, it takes effect on the next built picker.
+	UpdateConfig(config serviceconfig.LoadBalancingConfig)
+}
+
+// SubConnStateListener is implemented by the picker builders which need the
+// states of all the SubConns, not only the ready ones of
+// base.PickerBuildInfo.
+type SubConnStateListener interface {
+	// UpdateSubConnState is called with the state of sc, the SubConn of
+	// addr, before the base balancer handles it. It is Idle when sc is
+	// created.
+	UpdateSubConnState(sc balancer.SubConn, addr resolver.Address, state connectivity.State)
+}
+
+// ParseFunc parses the load balancing config of the balancer.
+type ParseFunc func(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error)
+
+// NewBalancerBuilder returns a base balancer builder, newPickerBuilder is
+// called for every balancer so that its pickers could share state, such as
+// the loads of the SubConns.
+func NewBalancerBuilder(name string, newPickerBuilder func() PickerBuilder, parse ParseFunc) balancer.Builder {
+	return &builder{
+		name:             name,
+		newPickerBuilder: newPickerBuilder,
+		parse:            parse,
+	}
+}
+
+type builder struct {
+	name             string
+	newPickerBuilder func() PickerBuilder
+	parse            ParseFunc
+}
+
+func (b *builder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	pb := b.newPickerBuilder()
+	if l, ok := pb.(SubConnStateListener); ok {
+		cc = &listenerCC{ClientConn: cc, l: l}
+	}
+	return &configBalancer{
+		Balancer: base.NewBalancerBuilder(b.name, pb, base.Config{}).Build(cc, opts),
+		pb:       pb,
+	}
+}
+
+func (b *builder) Name() string {
+	return b.name
+}
+
+func (b *builder) ParseConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	return b.parse(js)
+}
+
+type configBalancer struct {
+	balancer.Balancer
+	pb PickerBuilder
+}
+
+func (b *configBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
+	if s.BalancerConfig != nil {
+		b.pb.UpdateConfig(s.BalancerConfig)
+	}
+	return b.Balancer.UpdateClientConnState(s)
+}
+
+// listenerCC passes the states of the SubConns created by the base balancer
+// to its SubConnStateListener.
+type listenerCC struct {
+	balancer.ClientConn
+	l SubConnStateListener
+}
+
+func (cc *listenerCC) NewSubConn(addrs []resolver.Address, opts balancer.NewSubConnOptions) (balancer.SubConn, error) {
+	var sc balancer.SubConn
+	listener := opts.StateListener
+	opts.StateListener = func(state balancer.SubConnState) {
+		cc.l.UpdateSubConnState(sc, addrs[0], state.ConnectivityState)
+		listener(state)
+	}
+
+	sc, err := cc.ClientConn.NewSubConn(addrs, opts)
+	if err != nil {
+		return nil, err
+	}
+	cc.l.UpdateSubConnState(sc, addrs[0], connectivity.Idle)
+	return sc, nil
+}
+
+// ParseChildPolicy returns the first registered balancer of policies, such as
+// [{"robin": {}}], and its parsed config, which is nil if the balancer has
+// no ConfigParser.
+func ParseChildPolicy(policies []map[string]json.RawMessage) (string, serviceconfig.LoadBalancingConfig, error) {
+	for _, policy := range policies {
+		for name, js := range policy {
+			b := balancer.Get(name)
+			if b == nil {
+				continue
+			}
+			parser, ok := b.(balancer.ConfigParser)
+			if !ok {
+				return name, nil, nil
+			}
+			config, err := parser.ParseConfig(js)
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid config of child policy %s: %v", name, err)
+			}
+			return name, config, nil
+		}
+	}
+	return "", nil, errors.New("no registered child policy")
+}
@@ -0,0 +1,24 @@
+// Package failure tells the failed RPCs of the backends from the ones
+// rejected for the requests, for the balancers which react to the failures.
+package failure
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// failureCodes are the codes of the failures of the backends, the ones of
+// the 5xx errors in HTTP, which could be answered faster than the successful
+// RPCs.
+var failureCodes = map[codes.Code]bool{
+	codes.Unknown:          true,
+	codes.DeadlineExceeded: true,
+	codes.Internal:         true,
+	codes.Unavailable:      true,
+	codes.DataLoss:         true,
+}
+
+// Is reports whether err is a failure of the backend.
+func Is(err error) bool {
+	return err != nil && failureCodes[status.Code(err)]
+}
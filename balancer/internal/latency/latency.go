@@ -0,0 +1,131 @@
+// Package latency keeps the outstanding requests and the peak EWMA of the
+// latency of the SubConns, for the latency-aware balancers, ewma and p2c in
+// its ewma mode.
+package latency
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+
+	"github.com/dodoZeng/grpclb/balancer/internal/failure"
+)
+
+// DefaultDecay is the time in which the latency of a SubConn decays, unless
+// it is set in the service config.
+const DefaultDecay = 10 * time.Second
+
+// Penalty is the latency of a failed request, and the cost of each
+// outstanding request of a SubConn without any latency yet, so that the
+// new SubConns are probed one request at a time.
+const Penalty = float64(time.Second)
+
+// ParseDecay parses the decay in the service config, it is DefaultDecay if
+// s is empty.
+func ParseDecay(s string) (time.Duration, error) {
+	if len(s) <= 0 {
+		return DefaultDecay, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid decay %q: %v", s, err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("decay %v should be positive", d)
+	}
+	return d, nil
+}
+
+// Stats is the outstanding requests of a SubConn and the peak EWMA of its
+// latency.
+type Stats struct {
+	outstanding int64
+
+	mu sync.Mutex
+	// latency is in nanoseconds, stamp is the time it was last updated.
+	latency float64
+	stamp   time.Time
+}
+
+// Start starts a request on the SubConn.
+func (s *Stats) Start() {
+	atomic.AddInt64(&s.outstanding, 1)
+}
+
+// Outstanding returns the number of the outstanding requests.
+func (s *Stats) Outstanding() int64 {
+	return atomic.LoadInt64(&s.outstanding)
+}
+
+// Done finishes the request started at start, and adds its latency to the
+// EWMA. A failed request counts as Penalty at least. A latency above the
+// average replaces it at once, so that a slow SubConn is avoided quickly,
+// and recovers by decay.
+func (s *Stats) Done(start time.Time, err error, decay time.Duration) {
+	now := time.Now()
+	rtt := float64(now.Sub(start))
+	if failure.Is(err) && rtt < Penalty {
+		rtt = Penalty
+	}
+
+	atomic.AddInt64(&s.outstanding, -1)
+	s.mu.Lock()
+	if rtt > s.latency {
+		s.latency = rtt
+	} else {
+		w := math.Exp(-float64(now.Sub(s.stamp)) / float64(decay))
+		s.latency = s.latency*w + rtt*(1-w)
+	}
+	s.stamp = now
+	s.mu.Unlock()
+}
+
+// Cost returns the expected cost of a request on the SubConn at now, the
+// latency times the outstanding requests. The latency decays towards 0
+// while there is no finished request, so that an idle SubConn is tried
+// again.
+func (s *Stats) Cost(decay time.Duration, now time.Time) float64 {
+	outstanding := float64(s.Outstanding())
+	s.mu.Lock()
+	latency, stamp := s.latency, s.stamp
+	s.mu.Unlock()
+
+	if latency == 0 && outstanding > 0 {
+		return Penalty * outstanding
+	}
+	if elapsed := now.Sub(stamp); elapsed > 0 {
+		latency *= math.Exp(-float64(elapsed) / float64(decay))
+	}
+	return latency * (outstanding + 1)
+}
+
+// Map is the stats of the SubConns of a balancer, which are shared by its
+// pickers. The zero value is ready to use.
+type Map struct {
+	stats map[balancer.SubConn]*Stats
+}
+
+// Update returns the ready SubConns with their stats. The stats of the
+// SubConns which are still ready are kept, so that the latency is not
+// forgotten when the picker is rebuilt.
+func (m *Map) Update(readySCs map[balancer.SubConn]base.SubConnInfo) ([]balancer.SubConn, []*Stats) {
+	stats := make(map[balancer.SubConn]*Stats, len(readySCs))
+	scs := make([]balancer.SubConn, 0, len(readySCs))
+	ss := make([]*Stats, 0, len(readySCs))
+	for sc := range readySCs {
+		s, ok := m.stats[sc]
+		if !ok {
+			s = &Stats{}
+		}
+		stats[sc] = s
+		scs = append(scs, sc)
+		ss = append(ss, s)
+	}
+	m.stats = stats
+	return scs, ss
+}
@@ -0,0 +1,151 @@
+// Package testutil runs the backends of the balancer tests on bufconn.
+package testutil
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/dodoZeng/grpclb/attributes"
+)
+
+// Backend is a health server, which answers the requests after Delay, or
+// fails them with Err if it is set. The connections to it fail if it is
+// Down.
+type Backend struct {
+	Addr  string
+	Meta  map[string]string
+	Delay time.Duration
+	Err   error
+	Down  bool
+
+	calls int64
+	lis   *bufconn.Listener
+	mu    sync.Mutex
+}
+
+// SetErr changes Err while the backend is serving.
+func (b *Backend) SetErr(err error) {
+	b.mu.Lock()
+	b.Err = err
+	b.mu.Unlock()
+}
+
+// Calls returns the number of the requests the backend received.
+func (b *Backend) Calls() int64 {
+	return atomic.LoadInt64(&b.calls)
+}
+
+func (b *Backend) intercept(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	atomic.AddInt64(&b.calls, 1)
+	time.Sleep(b.Delay)
+	b.mu.Lock()
+	err := b.Err
+	b.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// Addresses returns the resolved addresses of the backends.
+func Addresses(backends ...*Backend) []resolver.Address {
+	addrs := make([]resolver.Address, 0, len(backends))
+	for _, b := range backends {
+		addr := resolver.Address{Addr: b.Addr}
+		if b.Meta != nil {
+			addr = attributes.WithMeta(addr, b.Meta)
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// Dial starts the backends, and returns a ClientConn to them with the
+// balancer of lbConfig, such as {"ewma": {}}. They are stopped when the test
+// ends.
+func Dial(t *testing.T, lbConfig string, backends ...*Backend) *grpc.ClientConn {
+	t.Helper()
+	cc, _ := DialResolver(t, lbConfig, backends...)
+	return cc
+}
+
+// DialResolver is Dial which returns the resolver of the ClientConn as well,
+// whose updates could change the backends or the service config.
+func DialResolver(t *testing.T, lbConfig string, backends ...*Backend) (*grpc.ClientConn, *manual.Resolver) {
+	t.Helper()
+	lis := make(map[string]*bufconn.Listener, len(backends))
+	for _, b := range backends {
+		if b.Down {
+			continue
+		}
+		b.lis = bufconn.Listen(1 << 20)
+		srv := grpc.NewServer(grpc.UnaryInterceptor(b.intercept))
+		healthpb.RegisterHealthServer(srv, health.NewServer())
+		go srv.Serve(b.lis)
+		t.Cleanup(srv.Stop)
+		lis[b.Addr] = b.lis
+	}
+
+	r := manual.NewBuilderWithScheme("test")
+	r.InitialState(resolver.State{Addresses: Addresses(backends...)})
+	cc, err := grpc.NewClient(r.Scheme()+":///backends",
+		grpc.WithResolvers(r),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			l, ok := lis[addr]
+			if !ok {
+				return nil, fmt.Errorf("no backend at %s", addr)
+			}
+			return l.DialContext(ctx)
+		}),
+		grpc.WithDefaultServiceConfig(fmt.Sprintf(`{"loadBalancingConfig": [%s]}`, lbConfig)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cc.Close() })
+	return cc, r
+}
+
+// WarmUp sends the requests one by one on cc until all the backends have
+// received one, so that all the SubConns are ready.
+func WarmUp(t *testing.T, cc *grpc.ClientConn, backends ...*Backend) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for _, b := range backends {
+		for b.Calls() == 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("backend %s received no request", b.Addr)
+			}
+			Call(cc, 1)
+		}
+	}
+}
+
+// Call sends n requests one by one on cc, and ignores their errors.
+func Call(cc *grpc.ClientConn, n int) {
+	for i := 0; i < n; i++ {
+		CallContext(context.Background(), cc)
+	}
+}
+
+// CallContext sends a request with ctx on cc, which times out in 5s.
+func CallContext(ctx context.Context, cc *grpc.ClientConn) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	_, err := healthpb.NewHealthClient(cc).Check(ctx, &healthpb.HealthCheckRequest{})
+	return err
+}
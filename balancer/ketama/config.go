@@ -0,0 +1,50 @@
+package ketama
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// lbConfig is the config of the ketama balancer in the service config, such
+// as {"loadBalancingConfig": [{"ketama": {"hash": "xxhash", "replicas": 160,
+// "loadFactor": 1.25}}]}
+type lbConfig struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+
+	// Hash is the name of the hash function of the request keys, one of
+	// md5, crc32, fnv1a, xxhash and murmur3. The one of WithHash is used if
+	// it is empty.
+	Hash string `json:"hash,omitempty"`
+	// Replicas is the number of the virtual nodes of each SubConn, which
+	// should be a multiple of 4, 160 by default.
+	Replicas int `json:"replicas,omitempty"`
+	// LoadFactor enables consistent hashing with bounded loads, a SubConn is
+	// skipped when its in-flight RPCs exceed LoadFactor times the average.
+	LoadFactor float64 `json:"loadFactor,omitempty"`
+
+	hash HashFunc
+}
+
+func parseConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	var c lbConfig
+	if err := json.Unmarshal(js, &c); err != nil {
+		return nil, fmt.Errorf("ketama: unable to unmarshal config %s: %v", js, err)
+	}
+	if len(c.Hash) > 0 {
+		hash, ok := hashFuncs[strings.ToLower(c.Hash)]
+		if !ok {
+			return nil, fmt.Errorf("ketama: unknown hash %q, it should be one of md5, crc32, fnv1a, xxhash and murmur3", c.Hash)
+		}
+		c.hash = hash
+	}
+	if c.Replicas < 0 || c.Replicas%4 != 0 {
+		return nil, fmt.Errorf("ketama: replicas %d should be a positive multiple of 4", c.Replicas)
+	}
+	if c.LoadFactor != 0 && c.LoadFactor < 1 {
+		return nil, fmt.Errorf("ketama: loadFactor %v should be at least 1", c.LoadFactor)
+	}
+	return &c, nil
+}
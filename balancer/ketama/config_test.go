@@ -0,0 +1,47 @@
+package ketama
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	key := []byte("key")
+	for _, c := range []struct {
+		js         string
+		hash       HashFunc
+		replicas   int
+		loadFactor float64
+		err        string
+	}{
+		{`{}`, nil, 0, 0, ""},
+		{`{"hash": "xxhash", "replicas": 80, "loadFactor": 1.25}`, XXHash, 80, 1.25, ""},
+		{`{"hash": "CRC32"}`, CRC32, 0, 0, ""},
+		{`{"hash": "murmur3"}`, Murmur3, 0, 0, ""},
+		{`{"loadFactor": 1}`, nil, 0, 1, ""},
+		{`{"hash": "sha1"}`, nil, 0, 0, "unknown hash"},
+		{`{"replicas": 10}`, nil, 0, 0, "positive multiple of 4"},
+		{`{"replicas": -4}`, nil, 0, 0, "positive multiple of 4"},
+		{`{"loadFactor": 0.5}`, nil, 0, 0, "should be at least 1"},
+		{`{"replicas": "160"}`, nil, 0, 0, "unable to unmarshal"},
+	} {
+		config, err := parseConfig([]byte(c.js))
+		if len(c.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: error %v, want %q", c.js, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.js, err)
+			continue
+		}
+		lc := config.(*lbConfig)
+		if lc.Replicas != c.replicas || lc.LoadFactor != c.loadFactor {
+			t.Errorf("%s: replicas %d and loadFactor %v, want %d and %v", c.js, lc.Replicas, lc.LoadFactor, c.replicas, c.loadFactor)
+		}
+		if (lc.hash == nil) != (c.hash == nil) || lc.hash != nil && lc.hash(key) != c.hash(key) {
+			t.Errorf("%s: wrong hash", c.js)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package ketama
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"hash/crc32"
+	"hash/fnv"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/twmb/murmur3"
+)
+
+// HashFunc hashes a request key to its position on the ring.
+type HashFunc func(key []byte) uint32
+
+// The hash functions of the request keys.
+var (
+	// MD5 is the hash of libketama, it is the default one.
+	MD5 HashFunc = func(key []byte) uint32 {
+		digest := md5.Sum(key)
+		return binary.LittleEndian.Uint32(digest[:4])
+	}
+	CRC32 HashFunc = crc32.ChecksumIEEE
+	FNV1a HashFunc = func(key []byte) uint32 {
+		h := fnv.New32a()
+		h.Write(key)
+		return h.Sum32()
+	}
+	XXHash HashFunc = func(key []byte) uint32 {
+		return uint32(xxhash.Sum64(key))
+	}
+	Murmur3 HashFunc = murmur3.Sum32
+)
+
+// hashFuncs is the hash functions by their names in the config.
+var hashFuncs = map[string]HashFunc{
+	"md5":     MD5,
+	"crc32":   CRC32,
+	"fnv1a":   FNV1a,
+	"xxhash":  XXHash,
+	"murmur3": Murmur3,
+}
@@ -0,0 +1,95 @@
+package ketama
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"testing"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/resolver"
+)
+
+// testAddrs returns the addresses of n SubConns.
+func testAddrs(n int) []resolver.Address {
+	addrs := make([]resolver.Address, 0, n)
+	for i := 0; i < n; i++ {
+		addrs = append(addrs, resolver.Address{Addr: fmt.Sprintf("10.0.0.%d:80", i)})
+	}
+	return addrs
+}
+
+// ringPick returns the SubConn of the first virtual node clockwise from
+// hash on the ring of p.
+func ringPick(p *kPicker, hash uint32) balancer.SubConn {
+	pos := sort.Search(len(p.connHashs), func(i int) bool { return hash <= p.connHashs[i] })
+	return p.subConns[pos%len(p.subConns)]
+}
+
+func TestHashSelection(t *testing.T) {
+	// the hash of WithHash is used unless the config sets one
+	defaults := &kPickerBuilder{replicas: defaultReplicas, hash: FNV1a}
+	for _, c := range []struct {
+		js   string
+		hash HashFunc
+	}{
+		{`{}`, FNV1a},
+		{`{"hash": "md5"}`, MD5},
+		{`{"hash": "crc32"}`, CRC32},
+		{`{"hash": "fnv1a"}`, FNV1a},
+		{`{"hash": "xxhash"}`, XXHash},
+		{`{"hash": "murmur3"}`, Murmur3},
+	} {
+		config, err := parseConfig([]byte(c.js))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := &kPickerBuilder{defaults: defaults}
+		b.UpdateConfig(config)
+		p := buildPickerWith(b, testAddrs(5)...).(*kPicker)
+
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprint("user-", i)
+			res, err := p.Pick(balancer.PickInfo{Ctx: WithKey(context.Background(), key)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := ringPick(p, c.hash([]byte(key))); res.SubConn != want {
+				t.Fatalf("%s: key %s picked %s, want %s", c.js, key, res.SubConn.(*testSubConn).addr, want.(*testSubConn).addr)
+			}
+		}
+	}
+}
+
+func TestRingWrapsAround(t *testing.T) {
+	var hash uint32
+	a, b, c := &testSubConn{addr: "a"}, &testSubConn{addr: "b"}, &testSubConn{addr: "c"}
+	p := &kPicker{
+		subConns:  []balancer.SubConn{a, b, c},
+		connHashs: []uint32{100, 200, 300},
+		hash:      func([]byte) uint32 { return hash },
+	}
+
+	for _, tc := range []struct {
+		hash uint32
+		want *testSubConn
+	}{
+		{0, a},
+		{100, a},
+		{150, b},
+		{300, c},
+		// past the last node, back to the first one
+		{301, a},
+		{math.MaxUint32, a},
+	} {
+		hash = tc.hash
+		res, err := p.Pick(balancer.PickInfo{Ctx: WithKey(context.Background(), "key")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sc := res.SubConn.(*testSubConn); sc != tc.want {
+			t.Errorf("hash %d picked %s, want %s", tc.hash, sc.addr, tc.want.addr)
+		}
+	}
+}
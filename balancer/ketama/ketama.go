@@ -4,84 +4,245 @@
 package ketama
 
 import (
+	"crypto/md5"
+	"encoding/binary"
+	"math"
 	"sort"
 	"strconv"
+	"sync/atomic"
 
-	"golang.org/x/net/context"
 	"google.golang.org/grpc/balancer"
 	"google.golang.org/grpc/balancer/base"
-	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
 
-	consul_api "github.com/hashicorp/consul/api"
+	"github.com/dodoZeng/grpclb/attributes"
+	"github.com/dodoZeng/grpclb/balancer/internal/configbase"
+	"github.com/dodoZeng/grpclb/logging"
 )
 
 // BalancerName is the name of ketama balancer.
 const BalancerName = "ketama"
 
+var logger = logging.Component(BalancerName)
+
 // Key is the name of Key in the request
+//
+// Deprecated: use WithKey, which doesn't collide with other context values.
 const Key = "_grpclb-ketama-key"
 
-// newBuilder creates a new ketama balancer builder.
-func newBuilder() balancer.Builder {
-	return base.NewBalancerBuilder(BalancerName, &kPickerBuilder{})
+// defaultReplicas is the number of the virtual nodes of each SubConn on the
+// ring, each md5 digest gives 4 of them as libketama does.
+const defaultReplicas = 160
+
+// Option configures the ketama balancer builder.
+type Option func(*kPickerBuilder)
+
+// WithHash sets the hash function of the request keys, MD5 by default.
+func WithHash(hash HashFunc) Option {
+	return func(b *kPickerBuilder) {
+		b.hash = hash
+	}
+}
+
+// NewBuilder creates a new ketama balancer builder, it could be registered
+// with balancer.Register to replace the default one.
+func NewBuilder(opts ...Option) balancer.Builder {
+	b := &kPickerBuilder{
+		replicas: defaultReplicas,
+		hash:     MD5,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return configbase.NewBalancerBuilder(BalancerName, func() configbase.PickerBuilder {
+		pb := *b
+		pb.defaults = b
+		pb.loads = make(map[balancer.SubConn]*int64)
+		return &pb
+	}, parseConfig)
 }
 
 func init() {
-	balancer.Register(newBuilder())
+	balancer.Register(NewBuilder())
 }
 
-type kPickerBuilder struct{}
-
-func (*kPickerBuilder) Build(readySCs map[resolver.Address]balancer.SubConn) balancer.Picker {
-	//grpclog.Infof("ketamaPicker: newPicker called with readySCs: %v", readySCs)
-	scs := map[int]balancer.SubConn{}
-	hashs := []int{}
-	for addr, sc := range readySCs {
-		if s, ok := addr.Metadata.(*consul_api.AgentService); ok {
-			if h, err := strconv.Atoi(s.Meta["hash"]); err == nil {
-				hashs = append(hashs, h)
-				scs[h] = sc
+type kPickerBuilder struct {
+	replicas   int
+	hash       HashFunc
+	loadFactor float64
+
+	// defaults is the builder with the options, whose settings are used
+	// unless they are set in the config.
+	defaults *kPickerBuilder
+
+	// loads is the number of the in-flight RPCs of each SubConn, shared by
+	// the pickers of the balancer, total is the sum of them.
+	loads map[balancer.SubConn]*int64
+	total int64
+}
+
+func (b *kPickerBuilder) UpdateConfig(config serviceconfig.LoadBalancingConfig) {
+	c, ok := config.(*lbConfig)
+	if !ok {
+		return
+	}
+	b.replicas, b.hash, b.loadFactor = b.defaults.replicas, b.defaults.hash, c.LoadFactor
+	if c.Replicas > 0 {
+		b.replicas = c.Replicas
+	}
+	if c.hash != nil {
+		b.hash = c.hash
+	}
+}
+
+func (b *kPickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	readySCs := info.ReadySCs
+	if logger.V(1) {
+		logger.Infof("ketamaPicker: newPicker called with readySCs: %v", readySCs)
+	}
+	names := make(map[balancer.SubConn]string, len(readySCs))
+	counts := make(map[string]int, len(readySCs))
+	for sc, scInfo := range readySCs {
+		name := attributes.HashKey(scInfo.Address)
+		names[sc] = name
+		counts[name]++
+	}
+	// the SubConns with the same hash key would have the same points, and
+	// one of them would shadow the others
+	for sc, name := range names {
+		if n := counts[name]; n > 1 {
+			addr := readySCs[sc].Address.Addr
+			logger.Warningf("ketamaPicker: hash key %q is shared by %d SubConns, hashing %s with its address", name, n, addr)
+			names[sc] = name + "@" + addr
+		}
+	}
+
+	points := make([]point, 0, len(readySCs)*b.replicas)
+	for sc, name := range names {
+		for i := 0; i < b.replicas/4; i++ {
+			digest := md5.Sum([]byte(name + "-" + strconv.Itoa(i)))
+			for j := 0; j < 4; j++ {
+				points = append(points, point{
+					hash: binary.LittleEndian.Uint32(digest[j*4:]),
+					name: name,
+					sc:   sc,
+				})
 			}
 		}
 	}
-	sort.Ints(hashs)
+	// break the ties by name, so that the ring doesn't depend on the order
+	// of readySCs
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash != points[j].hash {
+			return points[i].hash < points[j].hash
+		}
+		return points[i].name < points[j].name
+	})
+
+	p := &kPicker{
+		subConns:   make([]balancer.SubConn, len(points)),
+		connHashs:  make([]uint32, len(points)),
+		hash:       b.hash,
+		loadFactor: b.loadFactor,
+	}
+	for i, pt := range points {
+		p.subConns[i] = pt.sc
+		p.connHashs[i] = pt.hash
+	}
+
+	if p.loadFactor > 0 {
+		loads := make(map[balancer.SubConn]*int64, len(readySCs))
+		for sc := range readySCs {
+			if load, ok := b.loads[sc]; ok {
+				loads[sc] = load
+			} else {
+				loads[sc] = new(int64)
+			}
+		}
+		b.loads = loads
 
-	return &kPicker{
-		subConns:  scs,
-		connHashs: hashs,
+		p.loads = make([]*int64, len(points))
+		for i, pt := range points {
+			p.loads[i] = loads[pt.sc]
+		}
+		p.nodes = len(readySCs)
+		p.total = &b.total
 	}
+	return p
+}
+
+// point is a virtual node on the ring.
+type point struct {
+	hash uint32
+	name string
+	sc   balancer.SubConn
 }
 
 type kPicker struct {
 	// subConns is the snapshot of the ketama balancer when this picker was
 	// created. The slice is immutable. Each Get() will do a hashing
 	// selection from it and return the selected SubConn.
-	subConns  map[int]balancer.SubConn
-	connHashs []int
+	// subConns[i] is the SubConn of the virtual node at connHashs[i], which
+	// is sorted.
+	subConns  []balancer.SubConn
+	connHashs []uint32
+	hash      HashFunc
+
+	// loadFactor enables consistent hashing with bounded loads, loads[i] is
+	// the load of subConns[i], nodes is the number of the SubConns.
+	loadFactor float64
+	loads      []*int64
+	nodes      int
+	total      *int64
 }
 
-func (p *kPicker) Pick(ctx context.Context, opts balancer.PickInfo) (balancer.SubConn, func(balancer.DoneInfo), error) {
+func (p *kPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
 	if len(p.subConns) <= 0 {
-		return nil, nil, balancer.ErrNoSubConnAvailable
+		return balancer.PickResult{}, balancer.ErrNoSubConnAvailable
 	}
 
 	pos := len(p.connHashs) - 1
-	if key, ok := ctx.Value(Key).(string); ok {
-		//hash := int(crc32.ChecksumIEEE([]byte(key)))
-		hash, _ := strconv.Atoi(key)
+	if key, ok := requestKey(info.Ctx); ok {
+		hash := p.hash(key)
 
+		// the first virtual node clockwise, which wraps around to the
+		// beginning of the ring
 		pos = sort.Search(len(p.connHashs), func(i int) bool {
 			return hash <= p.connHashs[i]
 		})
 		if pos >= len(p.connHashs) {
-			pos = len(p.connHashs) - 1
+			pos = 0
 		}
 	}
 
-	h := p.connHashs[pos]
-	if sc, ok := p.subConns[h]; ok {
-		return sc, nil, nil
+	if logger.V(2) {
+		logger.Infof("ketamaPicker: picked virtual node %d of %d", pos, len(p.subConns))
 	}
+	if p.loadFactor <= 0 {
+		return balancer.PickResult{SubConn: p.subConns[pos]}, nil
+	}
+	return p.pickBounded(pos), nil
+}
 
-	return nil, nil, balancer.ErrNoSubConnAvailable
+// pickBounded picks the first SubConn clockwise from pos whose load is below
+// the capacity, which is loadFactor times the average load.
+func (p *kPicker) pickBounded(pos int) balancer.PickResult {
+	capacity := int64(math.Ceil(p.loadFactor * float64(atomic.LoadInt64(p.total)+1) / float64(p.nodes)))
+	for i := 0; i < len(p.subConns); i++ {
+		if j := (pos + i) % len(p.subConns); atomic.LoadInt64(p.loads[j]) < capacity {
+			pos = j
+			break
+		}
+	}
+
+	load, total := p.loads[pos], p.total
+	atomic.AddInt64(load, 1)
+	atomic.AddInt64(total, 1)
+	return balancer.PickResult{
+		SubConn: p.subConns[pos],
+		Done: func(balancer.DoneInfo) {
+			atomic.AddInt64(load, -1)
+			atomic.AddInt64(total, -1)
+		},
+	}
 }
@@ -0,0 +1,170 @@
+package ketama
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync/atomic"
+	"testing"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/dodoZeng/grpclb/attributes"
+)
+
+type testSubConn struct {
+	balancer.SubConn
+	addr string
+}
+
+// buildPicker builds the picker of ketama for the addresses.
+func buildPicker(addrs ...resolver.Address) balancer.Picker {
+	return buildPickerWith(&kPickerBuilder{replicas: defaultReplicas, hash: MD5}, addrs...)
+}
+
+func buildPickerWith(b *kPickerBuilder, addrs ...resolver.Address) balancer.Picker {
+	info := base.PickerBuildInfo{ReadySCs: make(map[balancer.SubConn]base.SubConnInfo)}
+	for _, a := range addrs {
+		info.ReadySCs[&testSubConn{addr: a.Addr}] = base.SubConnInfo{Address: a}
+	}
+	return b.Build(info)
+}
+
+// pickAddr returns the address picked for the key.
+func pickAddr(t *testing.T, p balancer.Picker, key string) string {
+	t.Helper()
+	res, err := p.Pick(balancer.PickInfo{Ctx: WithKey(context.Background(), key)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.SubConn.(*testSubConn).addr
+}
+
+func TestRemapping(t *testing.T) {
+	const nodes, keys = 10, 20000
+
+	var addrs []resolver.Address
+	for i := 0; i <= nodes; i++ {
+		addrs = append(addrs, resolver.Address{Addr: fmt.Sprintf("10.0.0.%d:80", i)})
+	}
+	before, after := buildPicker(addrs[:nodes]...), buildPicker(addrs...)
+	joined := addrs[nodes].Addr
+
+	moved := 0
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprint("key-", i)
+		from, to := pickAddr(t, before, key), pickAddr(t, after, key)
+		if from == to {
+			continue
+		}
+		moved++
+		// a join only takes keys, the others keep theirs, and it is the
+		// same when the node leaves again
+		if to != joined {
+			t.Fatalf("key %s moved from %s to %s, not to the joined %s", key, from, to, joined)
+		}
+	}
+
+	want := keys / (nodes + 1)
+	t.Logf("%d of %d keys moved, %d expected", moved, keys, want)
+	if moved < want/2 || moved > want*3/2 {
+		t.Errorf("%d of %d keys moved, want about %d", moved, keys, want)
+	}
+}
+
+func TestDuplicateHashKeys(t *testing.T) {
+	a := attributes.WithHashKey(resolver.Address{Addr: "10.0.0.1:80"}, "same")
+	b := attributes.WithHashKey(resolver.Address{Addr: "10.0.0.2:80"}, "same")
+
+	// the ring doesn't depend on the order of the SubConns, and none of
+	// them is shadowed
+	var ring string
+	for i := 0; i < 10; i++ {
+		p := buildPicker(a, b)
+		picks := make(map[string]int)
+		var r string
+		for k := 0; k < 200; k++ {
+			addr := pickAddr(t, p, fmt.Sprint(k))
+			picks[addr]++
+			r += addr
+		}
+		if len(picks) != 2 {
+			t.Fatalf("picks %v, want both SubConns", picks)
+		}
+		if i > 0 && r != ring {
+			t.Fatal("the picks changed with the same SubConns")
+		}
+		ring = r
+	}
+}
+
+func TestBoundedLoads(t *testing.T) {
+	const nodes, loadFactor = 4, 1.25
+
+	var addrs []resolver.Address
+	for i := 0; i < nodes; i++ {
+		addrs = append(addrs, resolver.Address{Addr: fmt.Sprintf("10.0.0.%d:80", i)})
+	}
+	b := &kPickerBuilder{replicas: defaultReplicas, hash: MD5, loadFactor: loadFactor}
+	p := buildPickerWith(b, addrs...).(*kPicker)
+
+	// home is the SubConn of the key without the bound, and next is the one
+	// of the next virtual node clockwise which isn't home
+	key := []byte("key")
+	pos := sort.Search(len(p.connHashs), func(i int) bool { return MD5(key) <= p.connHashs[i] }) % len(p.connHashs)
+	home := p.subConns[pos]
+	next := home
+	for i := pos; next == home; i = (i + 1) % len(p.subConns) {
+		next = p.subConns[i]
+	}
+
+	var dones []func(balancer.DoneInfo)
+	loads := make(map[balancer.SubConn]int)
+	pick := func() balancer.SubConn {
+		t.Helper()
+		res, err := p.Pick(balancer.PickInfo{Ctx: WithKey(context.Background(), string(key))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dones = append(dones, res.Done)
+		loads[res.SubConn]++
+		return res.SubConn
+	}
+
+	if sc := pick(); sc != home {
+		t.Fatalf("first pick on %s, want home %s", sc.(*testSubConn).addr, home.(*testSubConn).addr)
+	}
+	// the capacity is ceil(1.25*2/4) = 1 for the second pick, which home
+	// has reached
+	if sc := pick(); sc != next {
+		t.Fatalf("second pick on %s, want the next node %s", sc.(*testSubConn).addr, next.(*testSubConn).addr)
+	}
+	for total := 3; total <= 40; total++ {
+		pick()
+		capacity := int(math.Ceil(loadFactor * float64(total) / nodes))
+		for sc, n := range loads {
+			if n > capacity {
+				t.Fatalf("load of %s is %d after %d picks, over the capacity %d", sc.(*testSubConn).addr, n, total, capacity)
+			}
+		}
+	}
+
+	// the loads drop when the RPCs are done, and the key is back home
+	for _, done := range dones {
+		done(balancer.DoneInfo{})
+	}
+	for sc, load := range b.loads {
+		if n := atomic.LoadInt64(load); n != 0 {
+			t.Errorf("load of %s is %d after all the RPCs are done", sc.(*testSubConn).addr, n)
+		}
+	}
+	if n := atomic.LoadInt64(&b.total); n != 0 {
+		t.Errorf("total load is %d after all the RPCs are done", n)
+	}
+	if sc := pick(); sc != home {
+		t.Errorf("pick on %s after the RPCs are done, want home %s", sc.(*testSubConn).addr, home.(*testSubConn).addr)
+	}
+}
@@ -0,0 +1,97 @@
+package ketama
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// keyType is the type of the context key of the request key.
+type keyType struct{}
+
+// WithKey returns a copy of ctx with the key of the request, which is hashed
+// to pick the SubConn.
+func WithKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, keyType{}, key)
+}
+
+// KeyFromContext returns the key of the request set by WithKey.
+func KeyFromContext(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(keyType{}).(string)
+	return key, ok
+}
+
+// requestKey returns the key of the request, set by WithKey or the
+// deprecated Key, which could be a string or a []byte.
+func requestKey(ctx context.Context) ([]byte, bool) {
+	if key, ok := KeyFromContext(ctx); ok {
+		return []byte(key), true
+	}
+	switch key := ctx.Value(Key).(type) {
+	case string:
+		return []byte(key), true
+	case []byte:
+		return key, true
+	}
+	return nil, false
+}
+
+// KeyFunc returns the key of a request, req is nil for streams.
+type KeyFunc func(ctx context.Context, method string, req interface{}) (string, bool)
+
+// FromMetadata returns a KeyFunc which reads the key from the outgoing
+// metadata of name.
+func FromMetadata(name string) KeyFunc {
+	return func(ctx context.Context, method string, req interface{}) (string, bool) {
+		md, ok := metadata.FromOutgoingContext(ctx)
+		if !ok {
+			return "", false
+		}
+		if vs := md.Get(name); len(vs) > 0 {
+			return vs[0], true
+		}
+		return "", false
+	}
+}
+
+// FromRequest returns a KeyFunc which picks the key from the request with
+// fn, such as a user ID field.
+func FromRequest(fn func(req interface{}) (string, bool)) KeyFunc {
+	return func(ctx context.Context, method string, req interface{}) (string, bool) {
+		if req == nil {
+			return "", false
+		}
+		return fn(req)
+	}
+}
+
+// withRequestKey sets the key returned by the first of keyFuncs, unless ctx
+// has one already.
+func withRequestKey(ctx context.Context, method string, req interface{}, keyFuncs []KeyFunc) context.Context {
+	if _, ok := requestKey(ctx); ok {
+		return ctx
+	}
+	for _, fn := range keyFuncs {
+		if key, ok := fn(ctx, method, req); ok {
+			return WithKey(ctx, key)
+		}
+	}
+	return ctx
+}
+
+// UnaryClientInterceptor returns an interceptor which sets the key of the
+// requests with keyFuncs.
+func UnaryClientInterceptor(keyFuncs ...KeyFunc) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return invoker(withRequestKey(ctx, method, req, keyFuncs), method, req, reply, cc, opts...)
+	}
+}
+
+// StreamClientInterceptor returns an interceptor which sets the key of the
+// streams with keyFuncs, there is no request when a stream is created.
+func StreamClientInterceptor(keyFuncs ...KeyFunc) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return streamer(withRequestKey(ctx, method, nil, keyFuncs), desc, cc, method, opts...)
+	}
+}
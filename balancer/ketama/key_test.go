@@ -0,0 +1,108 @@
+package ketama
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestRequestKey(t *testing.T) {
+	ctx := context.Background()
+	for _, c := range []struct {
+		name string
+		ctx  context.Context
+		key  string
+		ok   bool
+	}{
+		{"none", ctx, "", false},
+		{"WithKey", WithKey(ctx, "user-42"), "user-42", true},
+		{"deprecated string", context.WithValue(ctx, Key, "user-42"), "user-42", true},
+		{"deprecated bytes", context.WithValue(ctx, Key, []byte("user-42")), "user-42", true},
+		{"deprecated int", context.WithValue(ctx, Key, 42), "", false},
+		{"WithKey first", WithKey(context.WithValue(ctx, Key, "old"), "new"), "new", true},
+	} {
+		key, ok := requestKey(c.ctx)
+		if string(key) != c.key || ok != c.ok {
+			t.Errorf("%s: key %q, %v, want %q, %v", c.name, key, ok, c.key, c.ok)
+		}
+	}
+}
+
+type testRequest struct {
+	user string
+}
+
+func userOf(req interface{}) (string, bool) {
+	r, ok := req.(*testRequest)
+	if !ok || len(r.user) <= 0 {
+		return "", false
+	}
+	return r.user, true
+}
+
+func TestKeyFuncs(t *testing.T) {
+	md := metadata.AppendToOutgoingContext(context.Background(), "x-user", "md-user")
+	for _, c := range []struct {
+		name string
+		fn   KeyFunc
+		ctx  context.Context
+		req  interface{}
+		key  string
+		ok   bool
+	}{
+		{"metadata", FromMetadata("x-user"), md, nil, "md-user", true},
+		{"other metadata", FromMetadata("x-tenant"), md, nil, "", false},
+		{"no metadata", FromMetadata("x-user"), context.Background(), nil, "", false},
+		{"request", FromRequest(userOf), context.Background(), &testRequest{user: "req-user"}, "req-user", true},
+		{"empty request", FromRequest(userOf), context.Background(), &testRequest{}, "", false},
+		{"stream", FromRequest(userOf), context.Background(), nil, "", false},
+	} {
+		key, ok := c.fn(c.ctx, "/svc/Method", c.req)
+		if key != c.key || ok != c.ok {
+			t.Errorf("%s: key %q, %v, want %q, %v", c.name, key, ok, c.key, c.ok)
+		}
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	unary := UnaryClientInterceptor(FromRequest(userOf), FromMetadata("x-user"))
+	stream := StreamClientInterceptor(FromRequest(userOf), FromMetadata("x-user"))
+	md := metadata.AppendToOutgoingContext(context.Background(), "x-user", "md-user")
+
+	for _, c := range []struct {
+		name      string
+		ctx       context.Context
+		req       interface{}
+		unaryKey  string
+		streamKey string
+	}{
+		// the first KeyFunc with a key wins, the streams have no request
+		{"request and metadata", md, &testRequest{user: "req-user"}, "req-user", "md-user"},
+		{"metadata", md, &testRequest{}, "md-user", "md-user"},
+		{"none", context.Background(), &testRequest{}, "", ""},
+		// the key of the caller is kept
+		{"WithKey", WithKey(md, "own"), &testRequest{user: "req-user"}, "own", "own"},
+	} {
+		var key string
+		invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+			key, _ = KeyFromContext(ctx)
+			return nil
+		}
+		unary(c.ctx, "/svc/Method", c.req, nil, nil, invoker)
+		if key != c.unaryKey {
+			t.Errorf("%s: unary key %q, want %q", c.name, key, c.unaryKey)
+		}
+
+		key = ""
+		streamer := func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+			key, _ = KeyFromContext(ctx)
+			return nil, nil
+		}
+		stream(c.ctx, &grpc.StreamDesc{}, nil, "/svc/Method", streamer)
+		if key != c.streamKey {
+			t.Errorf("%s: stream key %q, want %q", c.name, key, c.streamKey)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package locality
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"google.golang.org/grpc/serviceconfig"
+
+	"github.com/dodoZeng/grpclb/balancer/internal/configbase"
+	"github.com/dodoZeng/grpclb/balancer/robin"
+)
+
+// defaultMinHealthyPercent is the percentage of the healthy SubConns of a
+// tier, below which its traffic begins to spill over. It is close to the
+// 71.4% (100/1.4) of the default overprovisioning factor 1.4 of Envoy.
+const defaultMinHealthyPercent = 70
+
+// lbConfig is the config of the locality balancer in the service config,
+// such as {"loadBalancingConfig": [{"locality": {"childPolicy": [{"p2c":
+// {}}], "minHealthyPercent": 70}}]}.
+type lbConfig struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+
+	// ChildPolicy is the balancer of the SubConns in each tier, the first
+	// registered one of the list is used, robin by default.
+	ChildPolicy []map[string]json.RawMessage `json:"childPolicy,omitempty"`
+
+	// MinHealthyPercent is the percentage of the ready SubConns of a tier
+	// to take all its share of the traffic. Below it, the share falls in
+	// proportion, and the rest spills over to the next tier.
+	MinHealthyPercent int `json:"minHealthyPercent"`
+
+	childName   string
+	childConfig serviceconfig.LoadBalancingConfig
+}
+
+// defaultConfig returns the config with the default values.
+func defaultConfig() *lbConfig {
+	return &lbConfig{
+		MinHealthyPercent: defaultMinHealthyPercent,
+		childName:         robin.BalancerName,
+	}
+}
+
+func parseConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	c := defaultConfig()
+	if err := json.Unmarshal(js, c); err != nil {
+		return nil, fmt.Errorf("locality: unable to unmarshal config %s: %v", js, err)
+	}
+	if c.MinHealthyPercent <= 0 || c.MinHealthyPercent > 100 {
+		return nil, fmt.Errorf("locality: minHealthyPercent %d should be in (0, 100]", c.MinHealthyPercent)
+	}
+
+	if len(c.ChildPolicy) == 0 {
+		return c, nil
+	}
+	name, config, err := configbase.ParseChildPolicy(c.ChildPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("locality: %v in %s", err, js)
+	}
+	c.childName, c.childConfig = name, config
+	return c, nil
+}
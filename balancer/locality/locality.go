@@ -0,0 +1,425 @@
+// Package locality defines a zone-aware balancer, which prefers the
+// SubConns in the zone of the client, and spills the traffic over to the
+// ones in its region, then to the others, when the healthy SubConns of the
+// zone are too few. The SubConns in each tier are balanced by a child
+// policy, robin by default. locality balancer is registered when this
+// package is imported.
+//
+// The zone and region of the addresses are read from their attributes,
+// which the consul resolver sets from the Meta of the services. The ones of
+// the client are set by WithZone and WithRegion, or the environment
+// variables GRPCLB_ZONE and GRPCLB_REGION, without them all the addresses
+// are in the same tier.
+package locality
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"math/rand"
+	"os"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+
+	"github.com/dodoZeng/grpclb/attributes"
+	"github.com/dodoZeng/grpclb/logging"
+)
+
+// BalancerName is the name of locality balancer.
+const BalancerName = "locality"
+
+// The environment variables of the zone and region of the client, which are
+// overridden by WithZone and WithRegion.
+const (
+	EnvZone   = "GRPCLB_ZONE"
+	EnvRegion = "GRPCLB_REGION"
+)
+
+var logger = logging.Component(BalancerName)
+
+var errNoAddresses = errors.New("locality: produced zero addresses")
+
+// Option configures the locality balancer builder.
+type Option func(*builder)
+
+// WithZone sets the zone of the client.
+func WithZone(zone string) Option {
+	return func(b *builder) {
+		b.zone = zone
+	}
+}
+
+// WithRegion sets the region of the client.
+func WithRegion(region string) Option {
+	return func(b *builder) {
+		b.region = region
+	}
+}
+
+// NewBuilder creates a new locality balancer builder, it could be
+// registered with balancer.Register to replace the default one.
+func NewBuilder(opts ...Option) balancer.Builder {
+	b := &builder{
+		zone:   os.Getenv(EnvZone),
+		region: os.Getenv(EnvRegion),
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+func init() {
+	balancer.Register(NewBuilder())
+}
+
+type builder struct {
+	zone   string
+	region string
+}
+
+func (b *builder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	if logger.V(1) {
+		logger.Infof("built balancer in zone %q of region %q", b.zone, b.region)
+	}
+	return &localityBalancer{
+		cc:     cc,
+		opts:   opts,
+		zone:   b.zone,
+		region: b.region,
+		config: defaultConfig(),
+	}
+}
+
+func (*builder) Name() string {
+	return BalancerName
+}
+
+func (*builder) ParseConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	return parseConfig(js)
+}
+
+// tier is the locality of the addresses relative to the client, in the
+// order of preference.
+type tier int
+
+const (
+	tierZone tier = iota
+	tierRegion
+	tierOther
+	numTiers
+)
+
+var tierNames = [numTiers]string{"zone", "region", "other"}
+
+// localityBalancer balances the tiers with a child balancer for each of
+// them. Its methods and the StateListeners of the SubConns are called by
+// gRPC one at a time, so it needs no lock.
+type localityBalancer struct {
+	cc     balancer.ClientConn
+	opts   balancer.BuildOptions
+	zone   string
+	region string
+
+	config      *lbConfig
+	childName   string
+	children    [numTiers]*child
+	resolverErr error
+	// updating holds the pickers of the children back until all of them are
+	// updated.
+	updating bool
+	closed   bool
+}
+
+// tierOf returns the tier of addr.
+func (b *localityBalancer) tierOf(addr resolver.Address) tier {
+	if len(b.zone) > 0 && attributes.Zone(addr) == b.zone {
+		return tierZone
+	}
+	if len(b.region) > 0 && attributes.Region(addr) == b.region {
+		return tierRegion
+	}
+	return tierOther
+}
+
+func (b *localityBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
+	if c, ok := s.BalancerConfig.(*lbConfig); ok {
+		b.config = c
+	}
+	if b.childName != b.config.childName {
+		for t := range b.children {
+			b.closeChild(tier(t))
+		}
+		b.childName = b.config.childName
+	}
+	b.resolverErr = nil
+
+	var addrs [numTiers][]resolver.Address
+	for _, a := range s.ResolverState.Addresses {
+		t := b.tierOf(a)
+		addrs[t] = append(addrs[t], a)
+	}
+	var endpoints [numTiers][]resolver.Endpoint
+	for _, e := range s.ResolverState.Endpoints {
+		if len(e.Addresses) > 0 {
+			t := b.tierOf(e.Addresses[0])
+			endpoints[t] = append(endpoints[t], e)
+		}
+	}
+
+	b.updating = true
+	for t := range b.children {
+		if len(addrs[t]) == 0 && len(endpoints[t]) == 0 {
+			b.closeChild(tier(t))
+			continue
+		}
+		c := b.children[t]
+		if c == nil {
+			builder := balancer.Get(b.childName)
+			if builder == nil {
+				logger.Errorf("child policy %s is not registered", b.childName)
+				break
+			}
+			c = &child{
+				ClientConn: b.cc,
+				b:          b,
+				tier:       tier(t),
+				states:     make(map[balancer.SubConn]connectivity.State),
+			}
+			c.balancer = builder.Build(c, b.opts)
+			b.children[t] = c
+		}
+
+		cs := s
+		cs.ResolverState.Addresses = addrs[t]
+		cs.ResolverState.Endpoints = endpoints[t]
+		cs.BalancerConfig = b.config.childConfig
+		if err := c.balancer.UpdateClientConnState(cs); err != nil {
+			logger.Warningf("child policy of tier %s: %v", tierNames[t], err)
+		}
+	}
+	b.updating = false
+
+	b.updateState()
+	if len(s.ResolverState.Addresses) == 0 && len(s.ResolverState.Endpoints) == 0 {
+		return balancer.ErrBadResolverState
+	}
+	return nil
+}
+
+// closeChild closes the child balancer of the tier, and shuts its SubConns
+// down.
+func (b *localityBalancer) closeChild(t tier) {
+	c := b.children[t]
+	if c == nil {
+		return
+	}
+	b.children[t] = nil
+	c.balancer.Close()
+	for sc := range c.states {
+		sc.Shutdown()
+	}
+}
+
+func (b *localityBalancer) ResolverError(err error) {
+	b.resolverErr = err
+	b.updating = true
+	for _, c := range b.children {
+		if c != nil {
+			c.balancer.ResolverError(err)
+		}
+	}
+	b.updating = false
+	b.updateState()
+}
+
+// UpdateSubConnState is not called, the states of the SubConns are passed to
+// the StateListeners.
+func (b *localityBalancer) UpdateSubConnState(sc balancer.SubConn, state balancer.SubConnState) {
+	logger.Errorf("UpdateSubConnState(%v, %+v) called unexpectedly", sc, state)
+}
+
+func (b *localityBalancer) Close() {
+	b.closed = true
+	for t, c := range b.children {
+		if c != nil {
+			c.balancer.Close()
+			b.children[t] = nil
+		}
+	}
+}
+
+func (b *localityBalancer) ExitIdle() {
+	for _, c := range b.children {
+		if c != nil {
+			c.balancer.ExitIdle()
+		}
+	}
+}
+
+// updateState sends the picker spreading the picks over the tiers. Each
+// tier takes the traffic left by the previous ones in proportion to its
+// healthy capacity, which is the percentage of its ready SubConns over
+// MinHealthyPercent, up to 1.
+func (b *localityBalancer) updateState() {
+	if b.updating || b.closed {
+		return
+	}
+
+	var (
+		tiers      []tierPicker
+		shares     [numTiers]float64
+		total      float64
+		remaining  = 1.0
+		connecting bool
+		first      *child
+	)
+	for t, c := range b.children {
+		if c == nil {
+			continue
+		}
+		if first == nil {
+			first = c
+		}
+		switch c.state.ConnectivityState {
+		case connectivity.Connecting, connectivity.Idle:
+			connecting = true
+			continue
+		case connectivity.Ready:
+		default:
+			continue
+		}
+
+		ready := 0
+		for _, s := range c.states {
+			if s == connectivity.Ready {
+				ready++
+			}
+		}
+		if ready == 0 || remaining <= 0 {
+			continue
+		}
+		shares[t] = remaining * math.Min(1, float64(ready*100)/float64(len(c.states)*b.config.MinHealthyPercent))
+		remaining -= shares[t]
+		total += shares[t]
+		tiers = append(tiers, tierPicker{picker: c.state.Picker, cum: total})
+	}
+
+	switch {
+	case len(tiers) > 0:
+		if logger.V(1) {
+			logger.Infof("localityPicker: shares of the tiers %v: %v", tierNames, shares)
+		}
+		b.cc.UpdateState(balancer.State{
+			ConnectivityState: connectivity.Ready,
+			Picker:            &picker{tiers: tiers, total: total},
+		})
+	case connecting:
+		b.cc.UpdateState(balancer.State{
+			ConnectivityState: connectivity.Connecting,
+			Picker:            base.NewErrPicker(balancer.ErrNoSubConnAvailable),
+		})
+	case first != nil && first.state.Picker != nil:
+		b.cc.UpdateState(balancer.State{
+			ConnectivityState: connectivity.TransientFailure,
+			Picker:            first.state.Picker,
+		})
+	default:
+		err := b.resolverErr
+		if err == nil {
+			err = errNoAddresses
+		}
+		b.cc.UpdateState(balancer.State{
+			ConnectivityState: connectivity.TransientFailure,
+			Picker:            base.NewErrPicker(err),
+		})
+	}
+}
+
+// child is the child balancer of a tier, and its ClientConn, which keeps
+// track of the states of its SubConns.
+type child struct {
+	balancer.ClientConn
+	b        *localityBalancer
+	tier     tier
+	balancer balancer.Balancer
+
+	// states is the states of the SubConns, which give the healthy capacity
+	// of the tier.
+	states map[balancer.SubConn]connectivity.State
+	state  balancer.State
+}
+
+func (c *child) NewSubConn(addrs []resolver.Address, opts balancer.NewSubConnOptions) (balancer.SubConn, error) {
+	var sc balancer.SubConn
+	listener := opts.StateListener
+	opts.StateListener = func(state balancer.SubConnState) {
+		c.updateSubConnState(sc, state, listener)
+	}
+
+	sc, err := c.ClientConn.NewSubConn(addrs, opts)
+	if err != nil {
+		return nil, err
+	}
+	c.states[sc] = connectivity.Idle
+	return sc, nil
+}
+
+// updateSubConnState records the state of the SubConn, and passes it to the
+// child balancer.
+func (c *child) updateSubConnState(sc balancer.SubConn, state balancer.SubConnState, listener func(balancer.SubConnState)) {
+	old, ok := c.states[sc]
+	if !ok {
+		if listener != nil {
+			listener(state)
+		}
+		return
+	}
+	s := state.ConnectivityState
+	if s == connectivity.Shutdown {
+		delete(c.states, sc)
+	} else {
+		c.states[sc] = s
+	}
+
+	if listener != nil {
+		listener(state)
+	}
+	// the child may not send a picker for the change of the capacity
+	if c.b.children[c.tier] == c && (s == connectivity.Shutdown || (old == connectivity.Ready) != (s == connectivity.Ready)) {
+		c.b.updateState()
+	}
+}
+
+func (c *child) UpdateState(s balancer.State) {
+	c.state = s
+	if c.b.children[c.tier] == c {
+		c.b.updateState()
+	}
+}
+
+// tierPicker is the picker of a tier, cum is the sum of the shares of the
+// tier and the ones before it.
+type tierPicker struct {
+	picker balancer.Picker
+	cum    float64
+}
+
+type picker struct {
+	tiers []tierPicker
+	total float64
+}
+
+func (p *picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	r := rand.Float64() * p.total
+	for _, t := range p.tiers {
+		if r < t.cum {
+			return t.picker.Pick(info)
+		}
+	}
+	return p.tiers[len(p.tiers)-1].picker.Pick(info)
+}
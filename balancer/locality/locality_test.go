@@ -0,0 +1,183 @@
+package locality
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/dodoZeng/grpclb/attributes"
+)
+
+type testSubConn struct {
+	balancer.SubConn
+	addr     string
+	listener func(balancer.SubConnState)
+}
+
+func (*testSubConn) Connect()  {}
+func (*testSubConn) Shutdown() {}
+
+// testClientConn creates the SubConns of the locality balancer, which stay
+// CONNECTING until set.
+type testClientConn struct {
+	balancer.ClientConn
+	subConns map[string]*testSubConn
+	state    balancer.State
+}
+
+func (cc *testClientConn) NewSubConn(addrs []resolver.Address, opts balancer.NewSubConnOptions) (balancer.SubConn, error) {
+	sc := &testSubConn{addr: addrs[0].Addr, listener: opts.StateListener}
+	cc.subConns[sc.addr] = sc
+	return sc, nil
+}
+
+func (cc *testClientConn) UpdateState(s balancer.State) {
+	cc.state = s
+}
+
+func (cc *testClientConn) ResolveNow(resolver.ResolveNowOptions) {}
+
+// set sets the state of the SubConns of the addresses.
+func (cc *testClientConn) set(t *testing.T, state connectivity.State, addrs ...string) {
+	t.Helper()
+	for _, addr := range addrs {
+		sc, ok := cc.subConns[addr]
+		if !ok {
+			t.Fatalf("no SubConn of %s", addr)
+		}
+		sc.listener(balancer.SubConnState{ConnectivityState: state})
+	}
+}
+
+// shares returns the shares of the picks of the addresses.
+func (cc *testClientConn) shares(t *testing.T) map[string]float64 {
+	t.Helper()
+	if cc.state.ConnectivityState != connectivity.Ready {
+		t.Fatalf("balancer state %v, want READY", cc.state.ConnectivityState)
+	}
+	const picks = 20000
+	counts := make(map[string]int)
+	for i := 0; i < picks; i++ {
+		res, err := cc.state.Picker.Pick(balancer.PickInfo{Ctx: context.Background()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[res.SubConn.(*testSubConn).addr]++
+	}
+	shares := make(map[string]float64, len(counts))
+	for addr, n := range counts {
+		shares[addr] = float64(n) / picks
+	}
+	return shares
+}
+
+// tierShares sums the shares by the first letter of the addresses, z for
+// the zone, r for the region and o for the others.
+func tierShares(shares map[string]float64) map[byte]float64 {
+	tiers := make(map[byte]float64)
+	for addr, s := range shares {
+		tiers[addr[0]] += s
+	}
+	return tiers
+}
+
+func checkTiers(t *testing.T, name string, got, want map[byte]float64) {
+	t.Helper()
+	for _, tier := range []byte("zro") {
+		if math.Abs(got[tier]-want[tier]) > 0.02 {
+			t.Errorf("%s: share of tier %c is %.3f, want %.3f", name, tier, got[tier], want[tier])
+		}
+	}
+}
+
+// newTestBalancer builds a locality balancer in zone z1 of region r1 with
+// the addresses, zN are in the zone, rN in the other zone of the region, and
+// oN in another region.
+func newTestBalancer(t *testing.T, opts []Option, addrs ...string) *testClientConn {
+	t.Helper()
+	cc := &testClientConn{subConns: make(map[string]*testSubConn)}
+	b := NewBuilder(opts...).Build(cc, balancer.BuildOptions{})
+	t.Cleanup(b.Close)
+
+	var s resolver.State
+	for _, addr := range addrs {
+		a := resolver.Address{Addr: addr}
+		switch addr[0] {
+		case 'z':
+			a = attributes.WithRegion(attributes.WithZone(a, "z1"), "r1")
+		case 'r':
+			a = attributes.WithRegion(attributes.WithZone(a, "z2"), "r1")
+		default:
+			a = attributes.WithRegion(attributes.WithZone(a, "z3"), "r2")
+		}
+		s.Addresses = append(s.Addresses, a)
+	}
+	config, err := parseConfig([]byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.UpdateClientConnState(balancer.ClientConnState{ResolverState: s, BalancerConfig: config}); err != nil {
+		t.Fatal(err)
+	}
+	return cc
+}
+
+var inZone = []Option{WithZone("z1"), WithRegion("r1")}
+
+func TestTrafficStaysInZone(t *testing.T) {
+	cc := newTestBalancer(t, inZone, "z1", "z2", "r1", "r2", "o1", "o2")
+	cc.set(t, connectivity.Ready, "z1", "z2", "r1", "r2", "o1", "o2")
+
+	checkTiers(t, "all ready", tierShares(cc.shares(t)), map[byte]float64{'z': 1})
+}
+
+func TestPartialSpillOver(t *testing.T) {
+	cc := newTestBalancer(t, inZone, "z1", "z2", "z3", "z4", "r1", "r2", "o1")
+	cc.set(t, connectivity.Ready, "z1", "z2", "r1", "r2", "o1")
+	cc.set(t, connectivity.TransientFailure, "z3", "z4")
+
+	// half of the zone is ready, which takes 50/70 of the traffic, the
+	// region takes the rest
+	zone := 50.0 / 70
+	checkTiers(t, "half of the zone", tierShares(cc.shares(t)), map[byte]float64{'z': zone, 'r': 1 - zone})
+
+	// a quarter of the zone and half of the region are ready, the region
+	// takes its part of the rest, and the others the remainder
+	cc.set(t, connectivity.TransientFailure, "z2", "r2")
+	zone = 25.0 / 70
+	region := (1 - zone) * 50 / 70
+	checkTiers(t, "quarter of the zone", tierShares(cc.shares(t)), map[byte]float64{'z': zone, 'r': region, 'o': 1 - zone - region})
+}
+
+func TestFullSpillOver(t *testing.T) {
+	cc := newTestBalancer(t, inZone, "z1", "z2", "r1", "o1")
+	cc.set(t, connectivity.Ready, "r1", "o1")
+	cc.set(t, connectivity.TransientFailure, "z1", "z2")
+	checkTiers(t, "zone failed", tierShares(cc.shares(t)), map[byte]float64{'r': 1})
+
+	cc.set(t, connectivity.TransientFailure, "r1")
+	checkTiers(t, "region failed", tierShares(cc.shares(t)), map[byte]float64{'o': 1})
+
+	// the zone takes the traffic back once it is ready
+	cc.set(t, connectivity.Ready, "z1", "z2")
+	checkTiers(t, "zone back", tierShares(cc.shares(t)), map[byte]float64{'z': 1})
+}
+
+func TestNoClientZone(t *testing.T) {
+	t.Setenv(EnvZone, "")
+	t.Setenv(EnvRegion, "")
+	cc := newTestBalancer(t, nil, "z1", "r1", "o1", "o2")
+	cc.set(t, connectivity.Ready, "z1", "r1", "o1", "o2")
+
+	// all the addresses are in the same tier
+	shares := cc.shares(t)
+	for _, addr := range []string{"z1", "r1", "o1", "o2"} {
+		if math.Abs(shares[addr]-0.25) > 0.02 {
+			t.Errorf("share of %s is %.3f, want 0.25", addr, shares[addr])
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package outlier
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc/serviceconfig"
+
+	"github.com/dodoZeng/grpclb/balancer/internal/configbase"
+	"github.com/dodoZeng/grpclb/balancer/robin"
+)
+
+// lbConfig is the config of the outlier balancer in the service config, such
+// as {"loadBalancingConfig": [{"outlier": {"childPolicy": [{"robin": {}}],
+// "consecutiveErrors": 5, "baseEjectionTime": "30s"}}]}. The omitted fields
+// have the default values, and a zero threshold disables its ejection.
+type lbConfig struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+
+	// ChildPolicy is the balancer wrapped, the first registered one of the
+	// list is used, robin by default.
+	ChildPolicy []map[string]json.RawMessage `json:"childPolicy,omitempty"`
+
+	// Interval is the time between the evaluations of the failure rates and
+	// the returns of the ejected SubConns.
+	Interval string `json:"interval,omitempty"`
+	// BaseEjectionTime is the time a SubConn is ejected for, multiplied by
+	// the number of its consecutive ejections, up to MaxEjectionTime.
+	BaseEjectionTime string `json:"baseEjectionTime,omitempty"`
+	MaxEjectionTime  string `json:"maxEjectionTime,omitempty"`
+	// MaxEjectionPercent is the maximum percentage of the SubConns ejected
+	// at the same time.
+	MaxEjectionPercent int `json:"maxEjectionPercent"`
+
+	// ConsecutiveErrors ejects a SubConn after the number of consecutive
+	// failed RPCs.
+	ConsecutiveErrors int `json:"consecutiveErrors"`
+	// FailureRateThreshold ejects a SubConn whose percentage of failed RPCs
+	// in an interval reaches it, if there are at least
+	// FailureRateRequestVolume RPCs.
+	FailureRateThreshold     int `json:"failureRateThreshold"`
+	FailureRateRequestVolume int `json:"failureRateRequestVolume"`
+
+	childName        string
+	childConfig      serviceconfig.LoadBalancingConfig
+	interval         time.Duration
+	baseEjectionTime time.Duration
+	maxEjectionTime  time.Duration
+}
+
+// defaultConfig returns the config with the default values.
+func defaultConfig() *lbConfig {
+	return &lbConfig{
+		Interval:                 "10s",
+		BaseEjectionTime:         "30s",
+		MaxEjectionTime:          "300s",
+		MaxEjectionPercent:       10,
+		ConsecutiveErrors:        5,
+		FailureRateThreshold:     85,
+		FailureRateRequestVolume: 50,
+
+		childName:        robin.BalancerName,
+		interval:         10 * time.Second,
+		baseEjectionTime: 30 * time.Second,
+		maxEjectionTime:  300 * time.Second,
+	}
+}
+
+func parseConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	c := defaultConfig()
+	if err := json.Unmarshal(js, c); err != nil {
+		return nil, fmt.Errorf("outlier: unable to unmarshal config %s: %v", js, err)
+	}
+
+	for _, d := range []struct {
+		name string
+		s    string
+		d    *time.Duration
+	}{
+		{"interval", c.Interval, &c.interval},
+		{"baseEjectionTime", c.BaseEjectionTime, &c.baseEjectionTime},
+		{"maxEjectionTime", c.MaxEjectionTime, &c.maxEjectionTime},
+	} {
+		v, err := time.ParseDuration(d.s)
+		if err != nil {
+			return nil, fmt.Errorf("outlier: invalid %s %q: %v", d.name, d.s, err)
+		}
+		if v <= 0 {
+			return nil, fmt.Errorf("outlier: %s %v should be positive", d.name, v)
+		}
+		*d.d = v
+	}
+	if c.MaxEjectionPercent < 0 || c.MaxEjectionPercent > 100 {
+		return nil, fmt.Errorf("outlier: maxEjectionPercent %d should be in [0, 100]", c.MaxEjectionPercent)
+	}
+	if c.FailureRateThreshold < 0 || c.FailureRateThreshold > 100 {
+		return nil, fmt.Errorf("outlier: failureRateThreshold %d should be in [0, 100]", c.FailureRateThreshold)
+	}
+	if c.ConsecutiveErrors < 0 || c.FailureRateRequestVolume < 0 {
+		return nil, fmt.Errorf("outlier: consecutiveErrors and failureRateRequestVolume should not be negative")
+	}
+
+	if len(c.ChildPolicy) == 0 {
+		return c, nil
+	}
+	name, config, err := configbase.ParseChildPolicy(c.ChildPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("outlier: %v in %s", err, js)
+	}
+	c.childName, c.childConfig = name, config
+	return c, nil
+}
@@ -0,0 +1,427 @@
+// Package outlier defines an outlier detection balancer, which wraps any
+// other balancer and ejects the SubConns failing the RPCs for a while, even
+// if they pass the health check of the resolver. An ejected SubConn is
+// reported as TRANSIENT_FAILURE to the wrapped balancer, so that it is left
+// out of the picks. outlier balancer is registered when this package is
+// imported.
+package outlier
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+
+	"github.com/dodoZeng/grpclb/balancer/internal/failure"
+	"github.com/dodoZeng/grpclb/logging"
+)
+
+// BalancerName is the name of outlier balancer.
+const BalancerName = "outlier"
+
+var logger = logging.Component(BalancerName)
+
+func init() {
+	balancer.Register(&builder{})
+}
+
+type builder struct{}
+
+func (*builder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	config := defaultConfig()
+	b := &outlierBalancer{
+		cc:       cc,
+		opts:     opts,
+		config:   config,
+		infos:    make(map[balancer.SubConn]*subConnInfo),
+		ejectCh:  make(chan *subConnInfo, 1),
+		configCh: make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+
+		consecutiveErrors: int64(config.ConsecutiveErrors),
+	}
+	go b.run()
+	return b
+}
+
+func (*builder) Name() string {
+	return BalancerName
+}
+
+func (*builder) ParseConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	return parseConfig(js)
+}
+
+type outlierBalancer struct {
+	cc   balancer.ClientConn
+	opts balancer.BuildOptions
+
+	// mu serializes the calls of the wrapped balancer, which are made by
+	// gRPC and the ejections.
+	mu        sync.Mutex
+	config    *lbConfig
+	child     balancer.Balancer
+	childName string
+
+	// infos is the SubConns created by the wrapped balancer, it is read by
+	// the pickers.
+	infoMu sync.RWMutex
+	infos  map[balancer.SubConn]*subConnInfo
+
+	// consecutiveErrors is ConsecutiveErrors of the config, it is read by
+	// the done callbacks.
+	consecutiveErrors int64
+
+	ejectCh chan *subConnInfo
+	// configCh is signaled when a new config is installed, so that the
+	// evaluation timer is re-armed with its interval.
+	configCh chan struct{}
+	closed   chan struct{}
+}
+
+// subConnInfo is the outlier detection state of a SubConn.
+type subConnInfo struct {
+	sc   balancer.SubConn
+	addr string
+	// listener is the StateListener of the wrapped balancer.
+	listener func(balancer.SubConnState)
+
+	// the results of the RPCs, which are updated by the done callbacks.
+	successes   int64
+	failures    int64
+	consecutive int64
+
+	// guarded by mu of the balancer.
+	state     balancer.SubConnState
+	ejected   bool
+	ejectedAt time.Time
+	// ejections is the multiplier of the ejection time, which grows with
+	// each ejection and falls back in the healthy intervals.
+	ejections int
+}
+
+func (b *outlierBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if c, ok := s.BalancerConfig.(*lbConfig); ok {
+		b.config = c
+		atomic.StoreInt64(&b.consecutiveErrors, int64(c.ConsecutiveErrors))
+		select {
+		case b.configCh <- struct{}{}:
+		default:
+		}
+	}
+	if b.child == nil || b.childName != b.config.childName {
+		b.switchChild(b.config.childName)
+	}
+	if b.child == nil {
+		return balancer.ErrBadResolverState
+	}
+	s.BalancerConfig = b.config.childConfig
+	return b.child.UpdateClientConnState(s)
+}
+
+// switchChild closes the wrapped balancer, and builds the one of name, b.mu
+// must be held.
+func (b *outlierBalancer) switchChild(name string) {
+	if b.child != nil {
+		b.child.Close()
+		b.child = nil
+
+		b.infoMu.Lock()
+		infos := b.infos
+		b.infos = make(map[balancer.SubConn]*subConnInfo)
+		b.infoMu.Unlock()
+		for sc := range infos {
+			sc.Shutdown()
+		}
+	}
+
+	builder := balancer.Get(name)
+	if builder == nil {
+		logger.Errorf("child policy %s is not registered", name)
+		return
+	}
+	b.child, b.childName = builder.Build(&ccWrapper{ClientConn: b.cc, b: b}, b.opts), name
+}
+
+func (b *outlierBalancer) ResolverError(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.child != nil {
+		b.child.ResolverError(err)
+	}
+}
+
+// UpdateSubConnState is not called, the states of the SubConns are passed to
+// the StateListeners.
+func (b *outlierBalancer) UpdateSubConnState(sc balancer.SubConn, state balancer.SubConnState) {
+	logger.Errorf("UpdateSubConnState(%v, %+v) called unexpectedly", sc, state)
+}
+
+// updateSubConnState passes the state of the SubConn to the wrapped
+// balancer, unless it is ejected.
+func (b *outlierBalancer) updateSubConnState(info *subConnInfo, state balancer.SubConnState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	info.state = state
+	if state.ConnectivityState == connectivity.Shutdown {
+		b.infoMu.Lock()
+		if b.infos[info.sc] == info {
+			delete(b.infos, info.sc)
+		}
+		b.infoMu.Unlock()
+	} else if info.ejected {
+		// the wrapped balancer sees the real state after the ejection
+		return
+	}
+	b.passState(info, state)
+}
+
+// passState passes state to the wrapped balancer, through its StateListener
+// if it has one, b.mu must be held.
+func (b *outlierBalancer) passState(info *subConnInfo, state balancer.SubConnState) {
+	if info.listener != nil {
+		info.listener(state)
+	} else if b.child != nil {
+		b.child.UpdateSubConnState(info.sc, state)
+	}
+}
+
+func (b *outlierBalancer) Close() {
+	close(b.closed)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.child != nil {
+		b.child.Close()
+		b.child = nil
+	}
+}
+
+func (b *outlierBalancer) ExitIdle() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.child != nil {
+		b.child.ExitIdle()
+	}
+}
+
+// run ejects the SubConns with consecutive failures as soon as they are
+// found, and evaluates the failure rates every interval. The timer is
+// re-armed when a config changes the interval, including the first one
+// which may arrive after run starts with the default.
+func (b *outlierBalancer) run() {
+	b.mu.Lock()
+	interval := b.config.interval
+	b.mu.Unlock()
+
+	t := time.NewTimer(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-b.closed:
+			return
+		case info := <-b.ejectCh:
+			b.mu.Lock()
+			b.infoMu.RLock()
+			current := b.infos[info.sc] == info
+			b.infoMu.RUnlock()
+			if current && b.child != nil && !info.ejected && b.config.ConsecutiveErrors > 0 &&
+				atomic.LoadInt64(&info.consecutive) >= int64(b.config.ConsecutiveErrors) {
+				b.eject(info, time.Now(), "consecutive errors")
+			}
+			b.mu.Unlock()
+		case <-t.C:
+			b.mu.Lock()
+			b.evaluate(time.Now())
+			interval = b.config.interval
+			b.mu.Unlock()
+			t.Reset(interval)
+		case <-b.configCh:
+			b.mu.Lock()
+			changed := b.config.interval != interval
+			interval = b.config.interval
+			b.mu.Unlock()
+			if changed {
+				t.Reset(interval)
+			}
+		}
+	}
+}
+
+// evaluate brings back the SubConns whose ejection time has passed, and
+// ejects the ones whose failure rates are too high, b.mu must be held.
+func (b *outlierBalancer) evaluate(now time.Time) {
+	if b.child == nil {
+		return
+	}
+	c := b.config
+
+	b.infoMu.RLock()
+	infos := make([]*subConnInfo, 0, len(b.infos))
+	for _, info := range b.infos {
+		infos = append(infos, info)
+	}
+	b.infoMu.RUnlock()
+
+	for _, info := range infos {
+		successes := atomic.SwapInt64(&info.successes, 0)
+		failures := atomic.SwapInt64(&info.failures, 0)
+
+		if info.ejected {
+			if now.Sub(info.ejectedAt) >= b.ejectionTime(info) {
+				b.uneject(info)
+			}
+			continue
+		}
+
+		total := successes + failures
+		if c.FailureRateThreshold > 0 && total > 0 && total >= int64(c.FailureRateRequestVolume) &&
+			failures*100 >= int64(c.FailureRateThreshold)*total {
+			b.eject(info, now, "failure rate")
+		} else if failures == 0 && info.ejections > 0 {
+			info.ejections--
+		}
+	}
+}
+
+// ejectionTime returns how long the SubConn is ejected for.
+func (b *outlierBalancer) ejectionTime(info *subConnInfo) time.Duration {
+	d := b.config.baseEjectionTime * time.Duration(info.ejections)
+	if d > b.config.maxEjectionTime {
+		d = b.config.maxEjectionTime
+	}
+	return d
+}
+
+// eject reports the SubConn as TRANSIENT_FAILURE to the wrapped balancer,
+// unless too many SubConns are ejected, b.mu must be held.
+func (b *outlierBalancer) eject(info *subConnInfo, now time.Time, reason string) {
+	b.infoMu.RLock()
+	ejected, total := 0, len(b.infos)
+	for _, i := range b.infos {
+		if i.ejected {
+			ejected++
+		}
+	}
+	b.infoMu.RUnlock()
+	if ejected*100 >= b.config.MaxEjectionPercent*total {
+		return
+	}
+
+	info.ejected = true
+	info.ejectedAt = now
+	info.ejections++
+	atomic.StoreInt64(&info.consecutive, 0)
+	logger.Infof("ejected SubConn %s for %v because of %s", info.addr, b.ejectionTime(info), reason)
+	b.passState(info, balancer.SubConnState{
+		ConnectivityState: connectivity.TransientFailure,
+		ConnectionError:   fmt.Errorf("outlier: SubConn %s is ejected because of %s", info.addr, reason),
+	})
+}
+
+// uneject reports the real state of the SubConn to the wrapped balancer,
+// b.mu must be held.
+func (b *outlierBalancer) uneject(info *subConnInfo) {
+	info.ejected = false
+	atomic.StoreInt64(&info.consecutive, 0)
+	logger.Infof("returned SubConn %s", info.addr)
+	b.passState(info, info.state)
+}
+
+// record records the result of an RPC on the SubConn.
+func (b *outlierBalancer) record(info *subConnInfo, err error) {
+	if !failure.Is(err) {
+		atomic.AddInt64(&info.successes, 1)
+		atomic.StoreInt64(&info.consecutive, 0)
+		return
+	}
+
+	atomic.AddInt64(&info.failures, 1)
+	n, threshold := atomic.AddInt64(&info.consecutive, 1), atomic.LoadInt64(&b.consecutiveErrors)
+	if threshold > 0 && n >= threshold {
+		// it is sent again by the next failure if the channel is full
+		select {
+		case b.ejectCh <- info:
+		default:
+		}
+	}
+}
+
+// wrapDone wraps the done callback of the pick of sc to record the result.
+func (b *outlierBalancer) wrapDone(sc balancer.SubConn, done func(balancer.DoneInfo)) func(balancer.DoneInfo) {
+	b.infoMu.RLock()
+	info, ok := b.infos[sc]
+	b.infoMu.RUnlock()
+	if !ok {
+		return done
+	}
+	return func(di balancer.DoneInfo) {
+		b.record(info, di.Err)
+		if done != nil {
+			done(di)
+		}
+	}
+}
+
+// ccWrapper is the ClientConn of the wrapped balancer, which keeps track of
+// its SubConns and wraps its pickers.
+type ccWrapper struct {
+	balancer.ClientConn
+	b *outlierBalancer
+}
+
+func (cc *ccWrapper) NewSubConn(addrs []resolver.Address, opts balancer.NewSubConnOptions) (balancer.SubConn, error) {
+	info := &subConnInfo{
+		listener: opts.StateListener,
+		state:    balancer.SubConnState{ConnectivityState: connectivity.Idle},
+	}
+	if len(addrs) > 0 {
+		info.addr = addrs[0].Addr
+	}
+	opts.StateListener = func(state balancer.SubConnState) {
+		cc.b.updateSubConnState(info, state)
+	}
+
+	sc, err := cc.ClientConn.NewSubConn(addrs, opts)
+	if err != nil {
+		return nil, err
+	}
+	info.sc = sc
+	cc.b.infoMu.Lock()
+	cc.b.infos[sc] = info
+	cc.b.infoMu.Unlock()
+	return sc, nil
+}
+
+func (cc *ccWrapper) UpdateState(s balancer.State) {
+	if s.Picker != nil {
+		s.Picker = &picker{p: s.Picker, b: cc.b}
+	}
+	cc.ClientConn.UpdateState(s)
+}
+
+type picker struct {
+	p balancer.Picker
+	b *outlierBalancer
+}
+
+func (p *picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	res, err := p.p.Pick(info)
+	if err != nil {
+		return res, err
+	}
+	res.Done = p.b.wrapDone(res.SubConn, res.Done)
+	return res, nil
+}
@@ -0,0 +1,183 @@
+package outlier
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+	"google.golang.org/grpc/status"
+
+	"github.com/dodoZeng/grpclb/balancer/internal/testutil"
+)
+
+var errUnavailable = status.Error(codes.Unavailable, "down")
+
+// waitServing sends the requests until n of the backends receive them, and
+// returns the ones which do.
+func waitServing(t *testing.T, cc *grpc.ClientConn, n int, backends ...*testutil.Backend) []*testutil.Backend {
+	t.Helper()
+	var serving []*testutil.Backend
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		calls := make([]int64, len(backends))
+		for i, b := range backends {
+			calls[i] = b.Calls()
+		}
+		testutil.Call(cc, 10*len(backends))
+		serving = serving[:0]
+		for i, b := range backends {
+			if b.Calls() > calls[i] {
+				serving = append(serving, b)
+			}
+		}
+		if len(serving) == n {
+			return serving
+		}
+	}
+	t.Fatalf("%d backends are serving, want %d", len(serving), n)
+	return nil
+}
+
+// updateConfig updates the backends with the balancer of lbConfig.
+func updateConfig(t *testing.T, r *manual.Resolver, lbConfig string, backends ...*testutil.Backend) {
+	t.Helper()
+	sc := r.CC().ParseServiceConfig(`{"loadBalancingConfig": [` + lbConfig + `]}`)
+	if sc.Err != nil {
+		t.Fatal(sc.Err)
+	}
+	r.UpdateState(resolver.State{Addresses: testutil.Addresses(backends...), ServiceConfig: sc})
+}
+
+func TestConsecutiveErrors(t *testing.T) {
+	ok := &testutil.Backend{Addr: "ok"}
+	bad := &testutil.Backend{Addr: "bad", Err: errUnavailable}
+	cc := testutil.Dial(t, `{"outlier": {"consecutiveErrors": 3, "failureRateThreshold": 0, "maxEjectionPercent": 50}}`, ok, bad)
+
+	testutil.WarmUp(t, cc, ok, bad)
+	if serving := waitServing(t, cc, 1, ok, bad); serving[0] != ok {
+		t.Errorf("%s is serving, want ok", serving[0].Addr)
+	}
+	// bad failed consecutiveErrors times before it was ejected
+	if n := bad.Calls(); n < 3 {
+		t.Errorf("bad got %d requests before the ejection, want 3 at least", n)
+	}
+}
+
+func TestFailureRate(t *testing.T) {
+	ok := &testutil.Backend{Addr: "ok"}
+	bad := &testutil.Backend{Addr: "bad", Err: errUnavailable}
+	cc, r := testutil.DialResolver(t, `{"outlier": {"consecutiveErrors": 0}}`, ok, bad)
+	testutil.WarmUp(t, cc, ok, bad)
+
+	// the new interval takes effect at once, instead of after the default
+	// 10s of the last one
+	updateConfig(t, r, `{"outlier": {"interval": "50ms", "consecutiveErrors": 0,
+		"failureRateThreshold": 50, "failureRateRequestVolume": 5}}`, ok, bad)
+	if serving := waitServing(t, cc, 1, ok, bad); serving[0] != ok {
+		t.Errorf("%s is serving, want ok", serving[0].Addr)
+	}
+}
+
+func TestMaxEjectionPercent(t *testing.T) {
+	backends := []*testutil.Backend{
+		{Addr: "a", Err: errUnavailable},
+		{Addr: "b", Err: errUnavailable},
+		{Addr: "c", Err: errUnavailable},
+		{Addr: "d", Err: errUnavailable},
+	}
+	cc := testutil.Dial(t, `{"outlier": {"consecutiveErrors": 2, "failureRateThreshold": 0, "maxEjectionPercent": 50}}`, backends...)
+
+	testutil.WarmUp(t, cc, backends...)
+	waitServing(t, cc, 2, backends...)
+	// no more than half of them are ejected however they fail
+	testutil.Call(cc, 100)
+	waitServing(t, cc, 2, backends...)
+}
+
+func TestReturnAfterEjectionTime(t *testing.T) {
+	ok := &testutil.Backend{Addr: "ok"}
+	bad := &testutil.Backend{Addr: "bad", Err: errUnavailable}
+	cc := testutil.Dial(t, `{"outlier": {"interval": "50ms", "baseEjectionTime": "300ms",
+		"consecutiveErrors": 2, "failureRateThreshold": 0, "maxEjectionPercent": 50}}`, ok, bad)
+
+	testutil.WarmUp(t, cc, ok, bad)
+	waitServing(t, cc, 1, ok, bad)
+	ejected := time.Now()
+	bad.SetErr(nil)
+
+	waitServing(t, cc, 2, ok, bad)
+	if d := time.Since(ejected); d < 200*time.Millisecond {
+		t.Errorf("bad returned after %v, want the ejection time of 300ms", d)
+	}
+}
+
+func TestSwitchChildPolicy(t *testing.T) {
+	a := &testutil.Backend{Addr: "a"}
+	b := &testutil.Backend{Addr: "b"}
+	cc, r := testutil.DialResolver(t, `{"outlier": {"childPolicy": [{"robin": {}}]}}`, a, b)
+
+	testutil.WarmUp(t, cc, a, b)
+	waitServing(t, cc, 2, a, b)
+
+	updateConfig(t, r, `{"outlier": {"childPolicy": [{"pick_first": {}}]}}`, a, b)
+	waitServing(t, cc, 1, a, b)
+}
+
+type testSubConn struct {
+	balancer.SubConn
+	addr string
+}
+
+type stubBalancer struct {
+	balancer.Balancer
+}
+
+func TestEjectionTimeGrows(t *testing.T) {
+	c, err := parseConfig([]byte(`{"baseEjectionTime": "10s", "maxEjectionTime": "25s", "maxEjectionPercent": 50}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &outlierBalancer{
+		config: c.(*lbConfig),
+		child:  stubBalancer{},
+		infos:  make(map[balancer.SubConn]*subConnInfo),
+	}
+	var state connectivity.State
+	ready := balancer.SubConnState{ConnectivityState: connectivity.Ready}
+	info := &subConnInfo{
+		sc:       &testSubConn{addr: "a"},
+		addr:     "a",
+		state:    ready,
+		listener: func(s balancer.SubConnState) { state = s.ConnectivityState },
+	}
+	other := &subConnInfo{sc: &testSubConn{addr: "b"}, addr: "b", state: ready, listener: func(balancer.SubConnState) {}}
+	b.infos[info.sc], b.infos[other.sc] = info, other
+
+	now := time.Now()
+	for i, d := range []time.Duration{10 * time.Second, 20 * time.Second, 25 * time.Second, 25 * time.Second} {
+		b.eject(info, now, "test")
+		if !info.ejected || state != connectivity.TransientFailure {
+			t.Fatalf("ejection %d: ejected %v in state %v", i, info.ejected, state)
+		}
+		if b.evaluate(now.Add(d - time.Second)); !info.ejected {
+			t.Errorf("ejection %d: returned before %v", i, d)
+		}
+		now = now.Add(d)
+		if b.evaluate(now); info.ejected || state != connectivity.Ready {
+			t.Errorf("ejection %d: not returned after %v", i, d)
+		}
+	}
+
+	// the healthy intervals bring the ejection time back
+	for i := 0; i < 3; i++ {
+		b.evaluate(now)
+	}
+	b.eject(info, now, "test")
+	if d := b.ejectionTime(info); d != 20*time.Second {
+		t.Errorf("ejected for %v after the healthy intervals, want 20s", d)
+	}
+}
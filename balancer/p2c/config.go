@@ -0,0 +1,38 @@
+package p2c
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc/serviceconfig"
+
+	"github.com/dodoZeng/grpclb/balancer/internal/latency"
+)
+
+// lbConfig is the config of the p2c balancer in the service config, such as
+// {"loadBalancingConfig": [{"p2c": {"ewma": true, "decay": "10s"}}]}
+type lbConfig struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+
+	// EWMA weights the outstanding requests of the SubConns by the peak
+	// EWMA of their latencies, a failed request counts as 1s at least.
+	EWMA bool `json:"ewma,omitempty"`
+	// Decay is the time in which the latency decays, 10s by default.
+	Decay string `json:"decay,omitempty"`
+
+	decay time.Duration
+}
+
+func parseConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	var c lbConfig
+	if err := json.Unmarshal(js, &c); err != nil {
+		return nil, fmt.Errorf("p2c: unable to unmarshal config %s: %v", js, err)
+	}
+	d, err := latency.ParseDecay(c.Decay)
+	if err != nil {
+		return nil, fmt.Errorf("p2c: %v", err)
+	}
+	c.decay = d
+	return &c, nil
+}
@@ -0,0 +1,116 @@
+// Package p2c defines a power of two choices balancer, which picks the less
+// loaded one of two random SubConns. p2c balancer is registered when this
+// package is imported.
+package p2c
+
+import (
+	"math/rand"
+	"time"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/serviceconfig"
+
+	"github.com/dodoZeng/grpclb/balancer/internal/configbase"
+	"github.com/dodoZeng/grpclb/balancer/internal/latency"
+	"github.com/dodoZeng/grpclb/logging"
+)
+
+// BalancerName is the name of p2c balancer.
+const BalancerName = "p2c"
+
+var logger = logging.Component(BalancerName)
+
+// newBuilder creates a new p2c balancer builder.
+func newBuilder() balancer.Builder {
+	return configbase.NewBalancerBuilder(BalancerName, func() configbase.PickerBuilder {
+		return &pPickerBuilder{decay: latency.DefaultDecay}
+	}, parseConfig)
+}
+
+func init() {
+	balancer.Register(newBuilder())
+}
+
+type pPickerBuilder struct {
+	ewma  bool
+	decay time.Duration
+
+	// stats is the load of each SubConn, shared by the pickers of the
+	// balancer.
+	stats latency.Map
+}
+
+func (b *pPickerBuilder) UpdateConfig(config serviceconfig.LoadBalancingConfig) {
+	if c, ok := config.(*lbConfig); ok {
+		b.ewma = c.EWMA
+		b.decay = c.decay
+	}
+}
+
+func (b *pPickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	readySCs := info.ReadySCs
+	if logger.V(1) {
+		logger.Infof("p2cPicker: newPicker called with readySCs: %v", readySCs)
+	}
+
+	p := &pPicker{ewma: b.ewma, decay: b.decay}
+	p.subConns, p.stats = b.stats.Update(readySCs)
+	return p
+}
+
+type pPicker struct {
+	// subConns is the snapshot of the p2c balancer when this picker was
+	// created. The slice is immutable. stats[i] is the load of subConns[i].
+	subConns []balancer.SubConn
+	stats    []*latency.Stats
+
+	// ewma weights the outstanding requests by the latency of the SubConns,
+	// which decays in decay.
+	ewma  bool
+	decay time.Duration
+}
+
+func (p *pPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	n := len(p.subConns)
+	if n <= 0 {
+		return balancer.PickResult{}, balancer.ErrNoSubConnAvailable
+	}
+
+	now := time.Now()
+	i := 0
+	if n > 1 {
+		// two distinct random candidates
+		i = rand.Intn(n)
+		j := rand.Intn(n - 1)
+		if j >= i {
+			j++
+		}
+		if p.cost(j, now) < p.cost(i, now) {
+			i = j
+		}
+	}
+	if logger.V(2) {
+		logger.Infof("p2cPicker: picked SubConn %d of %d with %d outstanding requests", i, n, p.stats[i].Outstanding())
+	}
+
+	// the latency is kept without ewma as well, so that it is ready when
+	// the config turns ewma on
+	s := p.stats[i]
+	s.Start()
+	return balancer.PickResult{
+		SubConn: p.subConns[i],
+		Done: func(di balancer.DoneInfo) {
+			s.Done(now, di.Err, p.decay)
+		},
+	}, nil
+}
+
+// cost returns the load of subConns[i], which is the number of outstanding
+// requests, weighted by the latency if ewma is set.
+func (p *pPicker) cost(i int, now time.Time) float64 {
+	if !p.ewma {
+		return float64(p.stats[i].Outstanding())
+	}
+	return p.stats[i].Cost(p.decay, now)
+}
@@ -0,0 +1,58 @@
+package p2c
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/dodoZeng/grpclb/balancer/internal/testutil"
+)
+
+func TestLeastRequest(t *testing.T) {
+	busy := &testutil.Backend{Addr: "busy", Delay: 200 * time.Millisecond}
+	idle := &testutil.Backend{Addr: "idle"}
+	cc := testutil.Dial(t, `{"p2c": {}}`, busy, idle)
+	testutil.WarmUp(t, cc, busy, idle)
+
+	// the requests of busy stay outstanding, so that the candidates of the
+	// picks are compared by their loads, and idle wins unless tied
+	n := busy.Calls()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for deadline := time.Now().Add(500 * time.Millisecond); time.Now().Before(deadline); {
+				testutil.Call(cc, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// each request of busy holds a caller for 200ms
+	if n = busy.Calls() - n; n > 12 || n*10 > idle.Calls() {
+		t.Errorf("busy backend got %d requests, idle one %d", n, idle.Calls())
+	}
+}
+
+func TestEWMA(t *testing.T) {
+	fast := &testutil.Backend{Addr: "fast"}
+	slow := &testutil.Backend{Addr: "slow", Delay: 20 * time.Millisecond}
+	failing := &testutil.Backend{Addr: "failing", Err: status.Error(codes.Unavailable, "down")}
+	// a short decay, so that a scheduling blip of fast is forgotten soon
+	cc := testutil.Dial(t, `{"p2c": {"ewma": true, "decay": "100ms"}}`, fast, slow, failing)
+	testutil.WarmUp(t, cc, fast, slow, failing)
+
+	// fast wins all the picks it is a candidate of, which are 2/3 of them,
+	// slow wins the ones against failing, whose requests count as the
+	// penalty latency
+	calls := []int64{fast.Calls(), slow.Calls(), failing.Calls()}
+	testutil.Call(cc, 150)
+	fastN, slowN, failingN := fast.Calls()-calls[0], slow.Calls()-calls[1], failing.Calls()-calls[2]
+	if failingN > 10 || fastN <= slowN {
+		t.Errorf("fast, slow and failing backends got %d, %d and %d of 150 requests", fastN, slowN, failingN)
+	}
+}
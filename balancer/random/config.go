@@ -0,0 +1,26 @@
+package random
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// lbConfig is the config of the random balancer in the service config, such
+// as {"loadBalancingConfig": [{"random": {"seed": 42}}]}
+type lbConfig struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+
+	// Seed makes the picks reproducible, for tests and debugging. The global
+	// source of math/rand is used if it is 0.
+	Seed int64 `json:"seed,omitempty"`
+}
+
+func parseConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	var c lbConfig
+	if err := json.Unmarshal(js, &c); err != nil {
+		return nil, fmt.Errorf("random: unable to unmarshal config %s: %v", js, err)
+	}
+	return &c, nil
+}
@@ -0,0 +1,36 @@
+package random
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	for _, c := range []struct {
+		js   string
+		seed int64
+		err  string
+	}{
+		{`{}`, 0, ""},
+		{`{"seed": 42}`, 42, ""},
+		{`{"seed": -1}`, -1, ""},
+		{`{"seed": "42"}`, 0, "unable to unmarshal"},
+		{`{"seed": 1.5}`, 0, "unable to unmarshal"},
+		{`[]`, 0, "unable to unmarshal"},
+	} {
+		config, err := parseConfig([]byte(c.js))
+		if len(c.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: error %v, want %q", c.js, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.js, err)
+			continue
+		}
+		if seed := config.(*lbConfig).Seed; seed != c.seed {
+			t.Errorf("%s: seed %d, want %d", c.js, seed, c.seed)
+		}
+	}
+}
@@ -5,36 +5,68 @@ package random
 
 import (
 	"math/rand"
+	"sort"
+	"sync"
 
-	"golang.org/x/net/context"
 	"google.golang.org/grpc/balancer"
 	"google.golang.org/grpc/balancer/base"
-	"google.golang.org/grpc/grpclog"
-	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+
+	"github.com/dodoZeng/grpclb/balancer/internal/configbase"
+	"github.com/dodoZeng/grpclb/logging"
 )
 
 // BalancerName is the name of random balancer.
 const BalancerName = "random"
 
+var logger = logging.Component(BalancerName)
+
 // newBuilder creates a new random balancer builder.
 func newBuilder() balancer.Builder {
-	return base.NewBalancerBuilder(BalancerName, &rPickerBuilder{})
+	return configbase.NewBalancerBuilder(BalancerName, func() configbase.PickerBuilder {
+		return &rPickerBuilder{}
+	}, parseConfig)
 }
 
 func init() {
 	balancer.Register(newBuilder())
 }
 
-type rPickerBuilder struct{}
+type rPickerBuilder struct {
+	// rand is the source of the seed in the config, it is shared by the
+	// pickers of the balancer, so that the sequence goes on when the picker
+	// is rebuilt. It is nil without a seed, and the global source is used.
+	seed int64
+	rand *lockedRand
+}
+
+func (b *rPickerBuilder) UpdateConfig(config serviceconfig.LoadBalancingConfig) {
+	c, ok := config.(*lbConfig)
+	if !ok || c.Seed == b.seed {
+		return
+	}
+	b.seed, b.rand = c.Seed, nil
+	if c.Seed != 0 {
+		b.rand = &lockedRand{r: rand.New(rand.NewSource(c.Seed))}
+	}
+}
 
-func (*rPickerBuilder) Build(readySCs map[resolver.Address]balancer.SubConn) balancer.Picker {
-	grpclog.Infof("randomPicker: newPicker called with readySCs: %v", readySCs)
-	var scs []balancer.SubConn
-	for _, sc := range readySCs {
+func (b *rPickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if logger.V(1) {
+		logger.Infof("randomPicker: newPicker called with readySCs: %v", info.ReadySCs)
+	}
+	scs := make([]balancer.SubConn, 0, len(info.ReadySCs))
+	for sc := range info.ReadySCs {
 		scs = append(scs, sc)
 	}
+	// the picks of a seed depend on the order of the SubConns
+	sort.Slice(scs, func(i, j int) bool {
+		return info.ReadySCs[scs[i]].Address.Addr < info.ReadySCs[scs[j]].Address.Addr
+	})
+
 	return &rPicker{
 		subConns: scs,
+		rand:     b.rand,
 	}
 }
 
@@ -43,13 +75,34 @@ type rPicker struct {
 	// created. The slice is immutable. Each Get() will do a random
 	// selection from it and return the selected SubConn.
 	subConns []balancer.SubConn
+	rand     *lockedRand
 }
 
-func (p *rPicker) Pick(ctx context.Context, opts balancer.PickInfo) (balancer.SubConn, func(balancer.DoneInfo), error) {
+func (p *rPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
 	if len(p.subConns) <= 0 {
-		return nil, nil, balancer.ErrNoSubConnAvailable
+		return balancer.PickResult{}, balancer.ErrNoSubConnAvailable
+	}
+
+	var sc balancer.SubConn
+	if p.rand != nil {
+		sc = p.subConns[p.rand.Intn(len(p.subConns))]
+	} else {
+		sc = p.subConns[rand.Intn(len(p.subConns))]
+	}
+	if logger.V(2) {
+		logger.Infof("randomPicker: picked %p of %d SubConns", sc, len(p.subConns))
 	}
+	return balancer.PickResult{SubConn: sc}, nil
+}
+
+// lockedRand is a rand.Rand safe for concurrent use.
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
 
-	sc := p.subConns[rand.Intn(len(p.subConns))]
-	return sc, nil, nil
+func (r *lockedRand) Intn(n int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.r.Intn(n)
 }
@@ -0,0 +1,42 @@
+package robin
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// The sources of the weights of the SubConns.
+const (
+	// weightAttributes reads the weight of the address set by the
+	// resolver, see package attributes.
+	weightAttributes = "attributes"
+	// weightEqual gives all the SubConns the same weight.
+	weightEqual = "equal"
+)
+
+// lbConfig is the config of the robin balancer in the service config, such
+// as {"loadBalancingConfig": [{"robin": {"weightSource": "equal"}}]}
+type lbConfig struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+
+	// WeightSource is where the weights of the SubConns come from, either
+	// attributes (the default) or equal.
+	WeightSource string `json:"weightSource,omitempty"`
+}
+
+func parseConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	var c lbConfig
+	if err := json.Unmarshal(js, &c); err != nil {
+		return nil, fmt.Errorf("robin: unable to unmarshal config %s: %v", js, err)
+	}
+	switch c.WeightSource {
+	case "":
+		c.WeightSource = weightAttributes
+	case weightAttributes, weightEqual:
+	default:
+		return nil, fmt.Errorf("robin: unknown weightSource %q, it should be %s or %s", c.WeightSource, weightAttributes, weightEqual)
+	}
+	return &c, nil
+}
@@ -0,0 +1,35 @@
+package robin
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	for _, c := range []struct {
+		js           string
+		weightSource string
+		err          string
+	}{
+		{`{}`, weightAttributes, ""},
+		{`{"weightSource": "attributes"}`, weightAttributes, ""},
+		{`{"weightSource": "equal"}`, weightEqual, ""},
+		{`{"weightSource": "latency"}`, "", "unknown weightSource"},
+		{`{"weightSource": 1}`, "", "unable to unmarshal"},
+	} {
+		config, err := parseConfig([]byte(c.js))
+		if len(c.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: error %v, want %q", c.js, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.js, err)
+			continue
+		}
+		if ws := config.(*lbConfig).WeightSource; ws != c.weightSource {
+			t.Errorf("%s: weightSource %q, want %q", c.js, ws, c.weightSource)
+		}
+	}
+}
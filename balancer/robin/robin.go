@@ -4,118 +4,130 @@
 package robin
 
 import (
-	"fmt"
-	"math/rand"
-	"strconv"
+	"sort"
+	"sync"
 
-	"golang.org/x/net/context"
 	"google.golang.org/grpc/balancer"
 	"google.golang.org/grpc/balancer/base"
-	"google.golang.org/grpc/grpclog"
-	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
 
-	consul_api "github.com/hashicorp/consul/api"
+	"github.com/dodoZeng/grpclb/attributes"
+	"github.com/dodoZeng/grpclb/balancer/internal/configbase"
+	"github.com/dodoZeng/grpclb/logging"
 )
 
 // BalancerName is the name of robin balancer.
 const BalancerName = "robin"
 
+var logger = logging.Component(BalancerName)
+
 // newBuilder creates a new robin balancer builder.
 func newBuilder() balancer.Builder {
-	return base.NewBalancerBuilder(BalancerName, &rPickerBuilder{})
+	return configbase.NewBalancerBuilder(BalancerName, func() configbase.PickerBuilder {
+		return &rPickerBuilder{}
+	}, parseConfig)
 }
 
 func init() {
 	balancer.Register(newBuilder())
 }
 
-type rPickerBuilder struct{}
+type rPickerBuilder struct {
+	weightSource string
 
-func (*rPickerBuilder) Build(readySCs map[resolver.Address]balancer.SubConn) balancer.Picker {
-	grpclog.Infof("robinPicker: newPicker called with readySCs: %v", readySCs)
+	// last is the last built picker, whose current weights are carried over
+	// to the next one.
+	last *rPicker
+}
 
-	picker := rPicker{
-		step:      0,
-		sumWeight: 0,
-		curPos:    0,
-		curIndex:  0,
+func (b *rPickerBuilder) UpdateConfig(config serviceconfig.LoadBalancingConfig) {
+	if c, ok := config.(*lbConfig); ok {
+		b.weightSource = c.WeightSource
 	}
-	total := 0
+}
 
-	for addr, sc := range readySCs {
+func (b *rPickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if logger.V(1) {
+		logger.Infof("robinPicker: newPicker called with readySCs: %v", info.ReadySCs)
+	}
+
+	scs := make([]balancer.SubConn, 0, len(info.ReadySCs))
+	for sc := range info.ReadySCs {
+		scs = append(scs, sc)
+	}
+	// keep the order of the picks stable across the pickers
+	sort.Slice(scs, func(i, j int) bool {
+		return info.ReadySCs[scs[i]].Address.Addr < info.ReadySCs[scs[j]].Address.Addr
+	})
+
+	picker := &rPicker{
+		subConns:       scs,
+		weights:        make([]int, len(scs)),
+		currentWeights: make([]int, len(scs)),
+	}
+	for i, sc := range scs {
 		w := 1
-		if s, ok := addr.Metadata.(*consul_api.AgentService); ok {
-			if n, err := strconv.Atoi(s.Meta["weight"]); err == nil {
-				w = n
-			}
+		if b.weightSource != weightEqual {
+			w = attributes.Weight(info.ReadySCs[sc].Address)
 		}
-
-		total += w
-		picker.subConns = append(picker.subConns, sc)
-		picker.upperWeights = append(picker.upperWeights, total)
+		picker.weights[i] = w
+		picker.sumWeight += w
 	}
 
-	if n := len(picker.upperWeights); n > 0 {
-		picker.step = total / n
-		picker.sumWeight = total
+	// carry the current weights of the SubConns over, otherwise every
+	// rebuild restarts the sequence, and the first picks go to the heaviest
+	// SubConn again
+	if last := b.last; last != nil {
+		current := make(map[balancer.SubConn]int, len(last.subConns))
+		last.mu.Lock()
+		for i, sc := range last.subConns {
+			current[sc] = last.currentWeights[i]
+		}
+		last.mu.Unlock()
+		for i, sc := range scs {
+			picker.currentWeights[i] = current[sc]
+		}
 	}
+	b.last = picker
 
-	return &picker
+	return picker
 }
 
 type rPicker struct {
 	// subConns is the snapshot of the robin balancer when this picker was
-	// created. The slice is immutable. Each Get() will do a robin
-	// selection from it and return the selected SubConn.
-	subConns     []balancer.SubConn
-	upperWeights []int
-	sumWeight    int
-	step         int
-	curPos       int
-	curIndex     int
+	// created. The slice is immutable. Each Get() will do a smooth weighted
+	// round-robin selection from it and return the selected SubConn.
+	subConns  []balancer.SubConn
+	weights   []int
+	sumWeight int
+
+	mu             sync.Mutex
+	currentWeights []int
 }
 
-func (p *rPicker) Pick(ctx context.Context, opts balancer.PickInfo) (balancer.SubConn, func(balancer.DoneInfo), error) {
+// Pick picks the SubConn as the smooth weighted round-robin of nginx does:
+// every current weight grows by its weight, the SubConn with the largest
+// current weight is picked, and its current weight drops by the sum of the
+// weights. For the weights {5, 1, 1} the picks are a, a, b, a, c, a, a.
+func (p *rPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
 	if len(p.subConns) <= 0 {
-		return nil, nil, balancer.ErrNoSubConnAvailable
+		return balancer.PickResult{}, balancer.ErrNoSubConnAvailable
 	}
 
-	// move one step
-	p.curPos = 0
-	p.curIndex = 0
-	for leftSpan := rand.Intn(p.sumWeight) + 1; leftSpan > 0; {
-		curSpan := p.upperWeights[p.curIndex] - p.curPos
-
-		if leftSpan <= curSpan {
-			break
+	p.mu.Lock()
+	best := 0
+	for i, w := range p.weights {
+		p.currentWeights[i] += w
+		if p.currentWeights[i] > p.currentWeights[best] {
+			best = i
 		}
+	}
+	p.currentWeights[best] -= p.sumWeight
+	p.mu.Unlock()
 
-		leftSpan -= curSpan
-		p.curPos = p.upperWeights[p.curIndex]
-		if p.curPos == p.sumWeight {
-			break
-		} else {
-			p.curIndex = (p.curIndex + 1) % len(p.upperWeights)
-		}
+	if logger.V(2) {
+		logger.Infof("robinPicker: picked SubConn %d of %d with weight %d", best, len(p.subConns), p.weights[best])
 	}
-	sc := p.subConns[p.curIndex]
-
-	// for leftSpan := p.step; leftSpan > 0; {
-	// 	if p.curPos == p.sumWeight {
-	// 		p.curPos = 0
-	// 		p.curIndex = 0
-	// 	}
-
-	// 	curSpan := p.upperWeights[p.curIndex] - p.curPos
-	// 	if leftSpan <= curSpan {
-	// 		p.curPos = (p.curPos + leftSpan) % (p.sumWeight + 1)
-	// 		leftSpan = 0
-	// 	} else {
-	// 		p.curPos = p.upperWeights[p.curIndex]
-	// 		p.curIndex = (p.curIndex + 1) % len(p.upperWeights)
-	// 	}
-	// }
-	fmt.Printf("curPos = %d, curIndex = %d, step = %d\n", p.curPos, p.curIndex, p.step)
-
-	return sc, nil, nil
+
+	return balancer.PickResult{SubConn: p.subConns[best]}, nil
 }
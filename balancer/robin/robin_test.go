@@ -0,0 +1,136 @@
+package robin
+
+import (
+	"sync"
+	"testing"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/dodoZeng/grpclb/attributes"
+)
+
+type testSubConn struct {
+	balancer.SubConn
+	addr string
+}
+
+// buildPicker builds the picker of robin for the addresses with the
+// weights.
+func buildPicker(weights map[string]int) balancer.Picker {
+	return (&rPickerBuilder{}).Build(buildInfo(weights))
+}
+
+func buildInfo(weights map[string]int) base.PickerBuildInfo {
+	info := base.PickerBuildInfo{ReadySCs: make(map[balancer.SubConn]base.SubConnInfo)}
+	for addr, w := range weights {
+		a := attributes.WithWeight(resolver.Address{Addr: addr}, w)
+		info.ReadySCs[&testSubConn{addr: addr}] = base.SubConnInfo{Address: a}
+	}
+	return info
+}
+
+func pickAddr(t *testing.T, p balancer.Picker) string {
+	res, err := p.Pick(balancer.PickInfo{})
+	if err != nil {
+		t.Error(err)
+		return ""
+	}
+	return res.SubConn.(*testSubConn).addr
+}
+
+func TestSmoothWeightedSequence(t *testing.T) {
+	p := buildPicker(map[string]int{"a": 5, "b": 1, "c": 1})
+
+	want := []string{"a", "a", "b", "a", "c", "a", "a"}
+	for round := 0; round < 3; round++ {
+		for i, w := range want {
+			if got := pickAddr(t, p); got != w {
+				t.Fatalf("round %d pick %d: got %s, want %s", round, i, got, w)
+			}
+		}
+	}
+}
+
+func TestWeightedProportions(t *testing.T) {
+	weights := map[string]int{"a": 1, "b": 2, "c": 3, "d": 10}
+	p := buildPicker(weights)
+
+	const rounds = 1000
+	picks := make(map[string]int)
+	for i := 0; i < rounds*16; i++ {
+		picks[pickAddr(t, p)]++
+	}
+	// the smooth weighted round-robin is exact in each round of the sum
+	for addr, w := range weights {
+		if picks[addr] != w*rounds {
+			t.Errorf("%s picked %d times, want %d", addr, picks[addr], w*rounds)
+		}
+	}
+}
+
+func TestConcurrentPicks(t *testing.T) {
+	weights := map[string]int{"a": 5, "b": 1, "c": 1}
+	p := buildPicker(weights)
+
+	const goroutines, picks = 8, 700
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		counts = make(map[string]int)
+	)
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			local := make(map[string]int)
+			for i := 0; i < picks; i++ {
+				local[pickAddr(t, p)]++
+			}
+			mu.Lock()
+			for addr, n := range local {
+				counts[addr] += n
+			}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	// every pick takes a whole step of the sequence, so the total is still
+	// exact however the picks interleave
+	for addr, w := range weights {
+		if want := w * goroutines * picks / 7; counts[addr] != want {
+			t.Errorf("%s picked %d times, want %d", addr, counts[addr], want)
+		}
+	}
+}
+
+func TestRebuildKeepsSequence(t *testing.T) {
+	b := &rPickerBuilder{}
+	info := buildInfo(map[string]int{"a": 5, "b": 1, "c": 1})
+
+	// the sequence goes on across the pickers of the same SubConns
+	want := []string{"a", "a", "b", "a", "c", "a", "a"}
+	for round := 0; round < 3; round++ {
+		for i, w := range want {
+			if got := pickAddr(t, b.Build(info)); got != w {
+				t.Fatalf("round %d pick %d: got %s, want %s", round, i, got, w)
+			}
+		}
+	}
+
+	// a new SubConn starts from 0, and the others keep their current
+	// weights
+	d := &testSubConn{addr: "d"}
+	info.ReadySCs[d] = base.SubConnInfo{Address: attributes.WithWeight(resolver.Address{Addr: "d"}, 3)}
+	picks := make(map[string]int)
+	for i := 0; i < 10*100; i++ {
+		picks[pickAddr(t, b.Build(info))]++
+	}
+	for addr, w := range map[string]int{"a": 5, "b": 1, "c": 1, "d": 3} {
+		if n := picks[addr]; n < w*100-1 || n > w*100+1 {
+			t.Errorf("%s picked %d times, want about %d", addr, n, w*100)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package split
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// The attributes of the addresses which the groups are made by.
+const (
+	attributeVersion = "version"
+	attributeZone    = "zone"
+	attributeRegion  = "region"
+	attributeTag     = "tag"
+)
+
+// lbConfig is the config of the split balancer in the service config, such
+// as {"loadBalancingConfig": [{"split": {"attribute": "version", "targets":
+// [{"value": "v2", "percent": 5}], "sticky": true}}]}, which sends 5% of the
+// traffic to version v2, and the rest to the others.
+type lbConfig struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+
+	// Attribute is the attribute of the addresses grouped by, one of
+	// version, zone, region and tag, version by default. With tag an
+	// address is in the group of the first target in its tags.
+	Attribute string `json:"attribute,omitempty"`
+	// Targets is the percentages of the traffic sent to the groups, the
+	// rest of 100% is sent to the addresses in none of them.
+	Targets []target `json:"targets,omitempty"`
+	// Sticky sends the requests with the same key, set by ketama.WithKey,
+	// to the same group while the groups don't change.
+	Sticky bool `json:"sticky,omitempty"`
+}
+
+// target is the percentage of the traffic sent to the group of value.
+type target struct {
+	Value   string  `json:"value"`
+	Percent float64 `json:"percent"`
+}
+
+func parseConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	var c lbConfig
+	if err := json.Unmarshal(js, &c); err != nil {
+		return nil, fmt.Errorf("split: unable to unmarshal config %s: %v", js, err)
+	}
+	switch c.Attribute {
+	case "":
+		c.Attribute = attributeVersion
+	case attributeVersion, attributeZone, attributeRegion, attributeTag:
+	default:
+		return nil, fmt.Errorf("split: unknown attribute %q, it should be one of version, zone, region and tag", c.Attribute)
+	}
+
+	values := make(map[string]bool, len(c.Targets))
+	var sum float64
+	for _, t := range c.Targets {
+		if len(t.Value) == 0 || values[t.Value] {
+			return nil, fmt.Errorf("split: target value %q should be non-empty and unique", t.Value)
+		}
+		values[t.Value] = true
+		if t.Percent < 0 {
+			return nil, fmt.Errorf("split: percent %v of %s should not be negative", t.Percent, t.Value)
+		}
+		sum += t.Percent
+	}
+	// allow for the rounding of the float sum
+	if sum > 100+1e-9 {
+		return nil, fmt.Errorf("split: percents of the targets sum to %v, over 100", sum)
+	}
+	return &c, nil
+}
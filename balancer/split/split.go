@@ -0,0 +1,192 @@
+// Package split defines a traffic splitting balancer, which groups the
+// addresses by an attribute, such as the version or a tag, and sends the
+// configured percentages of the traffic to the groups, for the canaries.
+// The SubConns are picked round-robin in each group. split balancer is
+// registered when this package is imported.
+//
+// The split is changed through the service config, such as the one in the
+// config_key of the consul resolver, which only rebuilds the picker, the
+// SubConns are kept connected.
+package split
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync/atomic"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+
+	"github.com/dodoZeng/grpclb/attributes"
+	"github.com/dodoZeng/grpclb/balancer/internal/configbase"
+	"github.com/dodoZeng/grpclb/balancer/ketama"
+	"github.com/dodoZeng/grpclb/logging"
+)
+
+// BalancerName is the name of split balancer.
+const BalancerName = "split"
+
+var logger = logging.Component(BalancerName)
+
+// newBuilder creates a new split balancer builder.
+func newBuilder() balancer.Builder {
+	return configbase.NewBalancerBuilder(BalancerName, func() configbase.PickerBuilder {
+		return &sPickerBuilder{config: &lbConfig{Attribute: attributeVersion}}
+	}, parseConfig)
+}
+
+func init() {
+	balancer.Register(newBuilder())
+}
+
+type sPickerBuilder struct {
+	config *lbConfig
+}
+
+func (b *sPickerBuilder) UpdateConfig(config serviceconfig.LoadBalancingConfig) {
+	if c, ok := config.(*lbConfig); ok {
+		b.config = c
+	}
+}
+
+// groupOf returns the index of the target of addr, or len(c.Targets) if it
+// is in none of them.
+func groupOf(c *lbConfig, addr resolver.Address) int {
+	var value string
+	switch c.Attribute {
+	case attributeTag:
+		for i, t := range c.Targets {
+			if attributes.HasTag(addr, t.Value) {
+				return i
+			}
+		}
+		return len(c.Targets)
+	case attributeZone:
+		value = attributes.Zone(addr)
+	case attributeRegion:
+		value = attributes.Region(addr)
+	default:
+		value = attributes.Version(addr)
+	}
+	for i, t := range c.Targets {
+		if t.Value == value {
+			return i
+		}
+	}
+	return len(c.Targets)
+}
+
+func (b *sPickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if logger.V(1) {
+		logger.Infof("splitPicker: newPicker called with readySCs: %v", info.ReadySCs)
+	}
+	c := b.config
+
+	scs := make([]balancer.SubConn, 0, len(info.ReadySCs))
+	for sc := range info.ReadySCs {
+		scs = append(scs, sc)
+	}
+	// keep the order of the picks stable across the pickers
+	sort.Slice(scs, func(i, j int) bool {
+		return info.ReadySCs[scs[i]].Address.Addr < info.ReadySCs[scs[j]].Address.Addr
+	})
+
+	// the last group is the addresses in none of the targets, which takes
+	// the rest of the traffic
+	groups := make([]*group, len(c.Targets)+1)
+	rest := 100.0
+	for i, t := range c.Targets {
+		groups[i] = &group{value: t.Value, percent: t.Percent}
+		rest -= t.Percent
+	}
+	groups[len(c.Targets)] = &group{percent: math.Max(rest, 0)}
+	for _, sc := range scs {
+		g := groups[groupOf(c, info.ReadySCs[sc].Address)]
+		g.subConns = append(g.subConns, sc)
+	}
+
+	// the share of a group without SubConns goes to the others in
+	// proportion to their percentages, and if none of the groups with
+	// SubConns has any, they share the traffic by their sizes
+	p := &sPicker{sticky: c.Sticky}
+	for _, g := range groups {
+		if len(g.subConns) > 0 && g.percent > 0 {
+			p.total += g.percent
+			g.cum = p.total
+			p.groups = append(p.groups, g)
+		}
+	}
+	if len(p.groups) == 0 {
+		for _, g := range groups {
+			if len(g.subConns) > 0 {
+				p.total += float64(len(g.subConns))
+				g.cum = p.total
+				p.groups = append(p.groups, g)
+			}
+		}
+	}
+
+	if logger.V(1) {
+		for _, g := range p.groups {
+			logger.Infof("splitPicker: group %q has %d SubConns, %.2f%% of the traffic", g.value, len(g.subConns), g.share()/p.total*100)
+		}
+	}
+	return p
+}
+
+// group is the ready SubConns of a target, cum is the sum of the shares of
+// the group and the ones before it in the picker.
+type group struct {
+	value    string
+	percent  float64
+	subConns []balancer.SubConn
+	cum      float64
+	next     uint32
+}
+
+// share returns the share of the group in the picker.
+func (g *group) share() float64 {
+	if g.percent > 0 {
+		return g.percent
+	}
+	return float64(len(g.subConns))
+}
+
+type sPicker struct {
+	// groups is the snapshot of the split balancer when this picker was
+	// created. The slice is immutable. Each Get() will select a group by
+	// the shares and pick its next SubConn.
+	groups []*group
+	total  float64
+	sticky bool
+}
+
+func (p *sPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	if len(p.groups) <= 0 {
+		return balancer.PickResult{}, balancer.ErrNoSubConnAvailable
+	}
+
+	var r float64
+	if key, ok := ketama.KeyFromContext(info.Ctx); p.sticky && ok {
+		r = float64(ketama.XXHash([]byte(key))) / (1 << 32) * p.total
+	} else {
+		r = rand.Float64() * p.total
+	}
+	g := p.groups[len(p.groups)-1]
+	for _, gg := range p.groups {
+		if r < gg.cum {
+			g = gg
+			break
+		}
+	}
+
+	n := atomic.AddUint32(&g.next, 1)
+	sc := g.subConns[(n-1)%uint32(len(g.subConns))]
+	if logger.V(2) {
+		logger.Infof("splitPicker: picked %p of group %q", sc, g.value)
+	}
+	return balancer.PickResult{SubConn: sc}, nil
+}
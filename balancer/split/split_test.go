@@ -0,0 +1,115 @@
+package split
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"testing"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/dodoZeng/grpclb/attributes"
+	"github.com/dodoZeng/grpclb/balancer/ketama"
+)
+
+type testSubConn struct {
+	balancer.SubConn
+	version string
+}
+
+// buildPicker builds the picker of split with the config for the numbers of
+// addresses of the versions.
+func buildPicker(t *testing.T, config string, versions map[string]int) balancer.Picker {
+	t.Helper()
+	c, err := parseConfig([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &sPickerBuilder{}
+	b.UpdateConfig(c)
+
+	info := base.PickerBuildInfo{ReadySCs: make(map[balancer.SubConn]base.SubConnInfo)}
+	for v, n := range versions {
+		for i := 0; i < n; i++ {
+			a := attributes.WithVersion(resolver.Address{Addr: fmt.Sprintf("%s-%d", v, i)}, v)
+			info.ReadySCs[&testSubConn{version: v}] = base.SubConnInfo{Address: a}
+		}
+	}
+	return b.Build(info)
+}
+
+func pickVersion(t *testing.T, p balancer.Picker, ctx context.Context) string {
+	res, err := p.Pick(balancer.PickInfo{Ctx: ctx})
+	if err != nil {
+		t.Error(err)
+		return ""
+	}
+	return res.SubConn.(*testSubConn).version
+}
+
+func TestSplitPercentages(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		config   string
+		versions map[string]int
+		want     map[string]float64
+	}{
+		{"canary", `{"targets": [{"value": "v2", "percent": 10}]}`,
+			map[string]int{"v1": 3, "v2": 1}, map[string]float64{"v1": 0.9, "v2": 0.1}},
+		{"two targets", `{"targets": [{"value": "v2", "percent": 20}, {"value": "v3", "percent": 30}]}`,
+			map[string]int{"v1": 2, "v2": 1, "v3": 2}, map[string]float64{"v1": 0.5, "v2": 0.2, "v3": 0.3}},
+		// the share of v3 without SubConns goes to the others in proportion
+		{"missing target", `{"targets": [{"value": "v2", "percent": 10}, {"value": "v3", "percent": 20}]}`,
+			map[string]int{"v1": 3, "v2": 1}, map[string]float64{"v1": 0.875, "v2": 0.125}},
+		// no group with a percentage has SubConns, they share by their sizes
+		{"no percentages", `{"targets": [{"value": "v2", "percent": 100}]}`,
+			map[string]int{"v1": 3, "v3": 1}, map[string]float64{"v1": 0.75, "v3": 0.25}},
+	} {
+		p := buildPicker(t, c.config, c.versions)
+		const picks = 100000
+		got := make(map[string]int)
+		for i := 0; i < picks; i++ {
+			got[pickVersion(t, p, context.Background())]++
+		}
+		for v, want := range c.want {
+			if share := float64(got[v]) / picks; math.Abs(share-want) > 0.01 {
+				t.Errorf("%s: %s got %.3f of the picks, want %.3f", c.name, v, share, want)
+			}
+		}
+		if len(got) != len(c.want) {
+			t.Errorf("%s: picked %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestStickySplit(t *testing.T) {
+	const config = `{"targets": [{"value": "v2", "percent": 10}], "sticky": true}`
+	versions := map[string]int{"v1": 3, "v2": 1}
+	p := buildPicker(t, config, versions)
+	// a picker rebuilt with the same groups, such as after a SubConn of a
+	// group reconnects
+	rebuilt := buildPicker(t, config, versions)
+
+	const keys = 10000
+	canary := 0
+	for i := 0; i < keys; i++ {
+		ctx := ketama.WithKey(context.Background(), fmt.Sprintf("user-%d", i))
+		v := pickVersion(t, p, ctx)
+		for j := 0; j < 3; j++ {
+			if again := pickVersion(t, p, ctx); again != v {
+				t.Fatalf("key %d: picked %s, then %s", i, v, again)
+			}
+		}
+		if again := pickVersion(t, rebuilt, ctx); again != v {
+			t.Fatalf("key %d: picked %s, then %s after the rebuild", i, v, again)
+		}
+		if v == "v2" {
+			canary++
+		}
+	}
+	if share := float64(canary) / keys; math.Abs(share-0.1) > 0.015 {
+		t.Errorf("%.3f of the keys are sent to v2, want 0.1", share)
+	}
+}
@@ -0,0 +1,117 @@
+package subset
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+
+	"github.com/dodoZeng/grpclb/attributes"
+)
+
+// The fallback policies when no address matches the selectors.
+const (
+	// fallbackAny picks any of the addresses.
+	fallbackAny = "any"
+	// fallbackDefault picks the addresses of DefaultSubset.
+	fallbackDefault = "default"
+	// fallbackFail fails the RPC with Unavailable.
+	fallbackFail = "fail"
+)
+
+// lbConfig is the config of the subset balancer in the service config, such
+// as {"loadBalancingConfig": [{"subset": {"selectors": [{"header":
+// "x-tenant", "meta": "tenant"}, {"header": "x-env", "tagPrefix": "env-"}],
+// "fallback": "default", "defaultSubset": {"meta": {"tenant": "shared"}}}}]}.
+type lbConfig struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+
+	// Selectors match the outgoing metadata of the requests with the
+	// addresses, a request is sent to the addresses matching all the
+	// selectors whose headers it has.
+	Selectors []selector `json:"selectors,omitempty"`
+	// Fallback is the policy when no address matches, or the matching
+	// SubConns are all in TRANSIENT_FAILURE, one of any, default and fail,
+	// any by default.
+	Fallback string `json:"fallback,omitempty"`
+	// DefaultSubset is the addresses of the requests without any of the
+	// headers, and of the fallback policy default. All the addresses if it
+	// is not set.
+	DefaultSubset *subsetSpec `json:"defaultSubset,omitempty"`
+}
+
+// selector matches the value of a header with the addresses.
+type selector struct {
+	// Header is the key of the outgoing metadata.
+	Header string `json:"header"`
+	// Meta is the key of the metadata of the addresses whose value should
+	// be the one of the header.
+	Meta string `json:"meta,omitempty"`
+	// TagPrefix matches the addresses with the tag of TagPrefix followed
+	// by the value of the header, if Meta is empty.
+	TagPrefix string `json:"tagPrefix,omitempty"`
+}
+
+// match reports whether addr matches the value of the header.
+func (s *selector) match(addr resolver.Address, value string) bool {
+	if len(s.Meta) > 0 {
+		v, ok := attributes.Meta(addr)[s.Meta]
+		return ok && v == value
+	}
+	return attributes.HasTag(addr, s.TagPrefix+value)
+}
+
+// subsetSpec is the addresses with all the tags and metadata.
+type subsetSpec struct {
+	Tags []string          `json:"tags,omitempty"`
+	Meta map[string]string `json:"meta,omitempty"`
+}
+
+// match reports whether addr is in the subset.
+func (s *subsetSpec) match(addr resolver.Address) bool {
+	for _, t := range s.Tags {
+		if !attributes.HasTag(addr, t) {
+			return false
+		}
+	}
+	meta := attributes.Meta(addr)
+	for k, v := range s.Meta {
+		if mv, ok := meta[k]; !ok || mv != v {
+			return false
+		}
+	}
+	return true
+}
+
+func parseConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	var c lbConfig
+	if err := json.Unmarshal(js, &c); err != nil {
+		return nil, fmt.Errorf("subset: unable to unmarshal config %s: %v", js, err)
+	}
+	for i := range c.Selectors {
+		s := &c.Selectors[i]
+		if len(s.Header) == 0 {
+			return nil, fmt.Errorf("subset: header of selector %d should not be empty", i)
+		}
+		if len(s.Meta) > 0 && len(s.TagPrefix) > 0 {
+			return nil, fmt.Errorf("subset: selector of %s should have one of meta and tagPrefix", s.Header)
+		}
+		// the keys of the metadata are lowercase
+		s.Header = strings.ToLower(s.Header)
+	}
+
+	switch c.Fallback {
+	case "":
+		c.Fallback = fallbackAny
+	case fallbackAny, fallbackFail:
+	case fallbackDefault:
+		if c.DefaultSubset == nil {
+			return nil, fmt.Errorf("subset: fallback default needs defaultSubset")
+		}
+	default:
+		return nil, fmt.Errorf("subset: unknown fallback %q, it should be one of any, default and fail", c.Fallback)
+	}
+	return &c, nil
+}
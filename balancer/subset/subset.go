@@ -0,0 +1,287 @@
+// Package subset defines a subset balancer, which routes the requests by
+// their outgoing metadata to the addresses whose tags or metadata match,
+// such as the backends of a tenant or a dark launch behind one target. The
+// SubConns are picked round-robin in each subset. subset balancer is
+// registered when this package is imported.
+//
+// A request is sent to the addresses matching all the selectors in the
+// config whose headers it has, and the one without any of the headers to
+// the default subset. When no address matches, or all the matching SubConns
+// are in TRANSIENT_FAILURE, the fallback policy sends it to any address, to
+// the default subset, or fails it with Unavailable. The request waits while
+// a matching SubConn is connecting.
+package subset
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+	"google.golang.org/grpc/status"
+
+	"github.com/dodoZeng/grpclb/balancer/internal/configbase"
+	"github.com/dodoZeng/grpclb/logging"
+)
+
+// BalancerName is the name of subset balancer.
+const BalancerName = "subset"
+
+var logger = logging.Component(BalancerName)
+
+// maxCachedSubsets is the number of the subsets cached by a picker, the
+// ones beyond it are matched on every pick.
+const maxCachedSubsets = 1024
+
+// newBuilder creates a new subset balancer builder.
+func newBuilder() balancer.Builder {
+	return configbase.NewBalancerBuilder(BalancerName, func() configbase.PickerBuilder {
+		return &sPickerBuilder{
+			config: &lbConfig{Fallback: fallbackAny},
+			states: make(map[balancer.SubConn]*subConnState),
+		}
+	}, parseConfig)
+}
+
+func init() {
+	balancer.Register(newBuilder())
+}
+
+type sPickerBuilder struct {
+	config *lbConfig
+	// states is the states of all the SubConns, ready or not, which are
+	// read by the pickers.
+	states map[balancer.SubConn]*subConnState
+}
+
+func (b *sPickerBuilder) UpdateConfig(config serviceconfig.LoadBalancingConfig) {
+	if c, ok := config.(*lbConfig); ok {
+		b.config = c
+	}
+}
+
+func (b *sPickerBuilder) UpdateSubConnState(sc balancer.SubConn, addr resolver.Address, state connectivity.State) {
+	s, ok := b.states[sc]
+	if !ok {
+		s = &subConnState{addr: addr}
+		b.states[sc] = s
+	}
+	switch state {
+	case connectivity.Shutdown:
+		delete(b.states, sc)
+	case connectivity.Idle, connectivity.Connecting:
+		// a SubConn stays in TRANSIENT_FAILURE until it is ready, as in the
+		// base balancer, so that the picks don't wait for its retries
+		if s.load() == connectivity.TransientFailure {
+			return
+		}
+	}
+	atomic.StoreInt32(&s.state, int32(state))
+}
+
+func (b *sPickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if logger.V(1) {
+		logger.Infof("subsetPicker: newPicker called with readySCs: %v", info.ReadySCs)
+	}
+
+	scs := make([]balancer.SubConn, 0, len(info.ReadySCs))
+	for sc := range info.ReadySCs {
+		scs = append(scs, sc)
+	}
+	// keep the order of the picks stable across the pickers
+	sort.Slice(scs, func(i, j int) bool {
+		return info.ReadySCs[scs[i]].Address.Addr < info.ReadySCs[scs[j]].Address.Addr
+	})
+
+	p := &sPicker{
+		config:   b.config,
+		subConns: scs,
+		addrs:    make([]resolver.Address, len(scs)),
+		subsets:  make(map[string]*subset),
+	}
+	for i, sc := range scs {
+		p.addrs[i] = info.ReadySCs[sc].Address
+	}
+	for sc, s := range b.states {
+		if _, ok := info.ReadySCs[sc]; !ok {
+			p.pending = append(p.pending, s)
+		}
+	}
+	p.all = p.newSubset(func(resolver.Address) bool { return true })
+	p.def = p.all
+	if spec := b.config.DefaultSubset; spec != nil {
+		p.def = p.newSubset(spec.match)
+	}
+	return p
+}
+
+// subConnState is the state of a SubConn, which changes while the pickers
+// read it.
+type subConnState struct {
+	addr  resolver.Address
+	state int32
+}
+
+func (s *subConnState) load() connectivity.State {
+	return connectivity.State(atomic.LoadInt32(&s.state))
+}
+
+// subset is the ready SubConns matching a request.
+type subset struct {
+	subConns []balancer.SubConn
+	// pending is the matching SubConns which are not ready, the picks wait
+	// for them while any of them is connecting instead of falling back.
+	pending []*subConnState
+	next    uint32
+}
+
+// available reports whether the subset has a ready SubConn, or one which
+// could be ready soon.
+func (s *subset) available() bool {
+	if len(s.subConns) > 0 {
+		return true
+	}
+	for _, sc := range s.pending {
+		if st := sc.load(); st == connectivity.Idle || st == connectivity.Connecting {
+			return true
+		}
+	}
+	return false
+}
+
+type sPicker struct {
+	config *lbConfig
+	// subConns is the snapshot of the subset balancer when this picker was
+	// created. The slice is immutable. Each Get() will match the subset of
+	// the request from it, and pick its next SubConn. addrs[i] is the
+	// address of subConns[i].
+	subConns []balancer.SubConn
+	addrs    []resolver.Address
+	// pending is the SubConns which were not ready when this picker was
+	// created.
+	pending []*subConnState
+
+	all *subset
+	def *subset
+
+	// subsets is the subsets by the headers of the requests.
+	mu      sync.RWMutex
+	subsets map[string]*subset
+}
+
+// newSubset returns the subset of the addresses which match.
+func (p *sPicker) newSubset(match func(resolver.Address) bool) *subset {
+	s := &subset{}
+	for i, sc := range p.subConns {
+		if match(p.addrs[i]) {
+			s.subConns = append(s.subConns, sc)
+		}
+	}
+	for _, sc := range p.pending {
+		if match(sc.addr) {
+			s.pending = append(s.pending, sc)
+		}
+	}
+	return s
+}
+
+// headers returns the values of the headers of the selectors in the
+// outgoing metadata of ctx, present[i] reports whether the request has the
+// header of selector i.
+func (p *sPicker) headers(ctx context.Context) (values []string, present []bool, ok bool) {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	values = make([]string, len(p.config.Selectors))
+	present = make([]bool, len(p.config.Selectors))
+	for i, s := range p.config.Selectors {
+		if vs := md.Get(s.Header); len(vs) > 0 {
+			values[i], present[i], ok = vs[0], true, true
+		}
+	}
+	return values, present, ok
+}
+
+// selected returns the subset of the values of the headers.
+func (p *sPicker) selected(values []string, present []bool) *subset {
+	var key strings.Builder
+	for i, v := range values {
+		if present[i] {
+			key.WriteString("=")
+			key.WriteString(v)
+		}
+		key.WriteByte(0)
+	}
+
+	p.mu.RLock()
+	s, ok := p.subsets[key.String()]
+	p.mu.RUnlock()
+	if ok {
+		return s
+	}
+
+	s = p.newSubset(func(addr resolver.Address) bool {
+		for i, sel := range p.config.Selectors {
+			if present[i] && !sel.match(addr, values[i]) {
+				return false
+			}
+		}
+		return true
+	})
+	p.mu.Lock()
+	if len(p.subsets) < maxCachedSubsets {
+		p.subsets[key.String()] = s
+	}
+	p.mu.Unlock()
+	return s
+}
+
+func (p *sPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	s := p.def
+	values, present, ok := p.headers(info.Ctx)
+	if ok {
+		s = p.selected(values, present)
+	}
+	if !s.available() {
+		switch p.config.Fallback {
+		case fallbackAny:
+			s = p.all
+		case fallbackDefault:
+			s = p.def
+		}
+		if !s.available() {
+			return balancer.PickResult{}, status.Errorf(codes.Unavailable, "subset: no available address matches %s", p.describe(values, present))
+		}
+	}
+	if len(s.subConns) <= 0 {
+		return balancer.PickResult{}, balancer.ErrNoSubConnAvailable
+	}
+
+	n := atomic.AddUint32(&s.next, 1)
+	sc := s.subConns[(n-1)%uint32(len(s.subConns))]
+	if logger.V(2) {
+		logger.Infof("subsetPicker: picked %p of %d SubConns for %s", sc, len(s.subConns), p.describe(values, present))
+	}
+	return balancer.PickResult{SubConn: sc}, nil
+}
+
+// describe returns the headers of the selectors in the request, such as
+// "x-tenant=a, x-env=dark".
+func (p *sPicker) describe(values []string, present []bool) string {
+	var headers []string
+	for i, s := range p.config.Selectors {
+		if present[i] {
+			headers = append(headers, s.Header+"="+values[i])
+		}
+	}
+	if len(headers) == 0 {
+		return "the default subset"
+	}
+	return strings.Join(headers, ", ")
+}
@@ -0,0 +1,168 @@
+package subset
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/status"
+
+	"github.com/dodoZeng/grpclb/attributes"
+	"github.com/dodoZeng/grpclb/balancer/internal/testutil"
+)
+
+type testSubConn struct {
+	balancer.SubConn
+	addr string
+}
+
+// testBalancer drives a subset picker builder as the base balancer does,
+// with a SubConn for each address of the tenants.
+type testBalancer struct {
+	t      *testing.T
+	b      *sPickerBuilder
+	addrs  map[*testSubConn]resolver.Address
+	states map[*testSubConn]connectivity.State
+}
+
+func newTestBalancer(t *testing.T, config string, tenants map[string]string) *testBalancer {
+	t.Helper()
+	c, err := parseConfig([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb := &testBalancer{
+		t:      t,
+		b:      &sPickerBuilder{states: make(map[balancer.SubConn]*subConnState)},
+		addrs:  make(map[*testSubConn]resolver.Address),
+		states: make(map[*testSubConn]connectivity.State),
+	}
+	tb.b.UpdateConfig(c)
+	for addr, tenant := range tenants {
+		sc := &testSubConn{addr: addr}
+		a := attributes.WithMeta(resolver.Address{Addr: addr}, map[string]string{"tenant": tenant})
+		tb.addrs[sc] = a
+		tb.set(sc, connectivity.Idle)
+	}
+	return tb
+}
+
+func (tb *testBalancer) subConn(addr string) *testSubConn {
+	for sc := range tb.addrs {
+		if sc.addr == addr {
+			return sc
+		}
+	}
+	tb.t.Fatalf("no SubConn of %s", addr)
+	return nil
+}
+
+func (tb *testBalancer) set(sc *testSubConn, state connectivity.State) {
+	tb.states[sc] = state
+	tb.b.UpdateSubConnState(sc, tb.addrs[sc], state)
+}
+
+// build builds a picker with the ready SubConns.
+func (tb *testBalancer) build() balancer.Picker {
+	info := base.PickerBuildInfo{ReadySCs: make(map[balancer.SubConn]base.SubConnInfo)}
+	for sc, state := range tb.states {
+		if state == connectivity.Ready {
+			info.ReadySCs[sc] = base.SubConnInfo{Address: tb.addrs[sc]}
+		}
+	}
+	return tb.b.Build(info)
+}
+
+// pick picks for tenant, and returns the address of the SubConn.
+func pick(p balancer.Picker, tenant string) (string, error) {
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-tenant", tenant)
+	res, err := p.Pick(balancer.PickInfo{Ctx: ctx})
+	if err != nil {
+		return "", err
+	}
+	return res.SubConn.(*testSubConn).addr, nil
+}
+
+func TestPickWaitsForConnecting(t *testing.T) {
+	tb := newTestBalancer(t, `{"selectors": [{"header": "x-tenant", "meta": "tenant"}]}`,
+		map[string]string{"a1": "a", "b1": "b"})
+	tb.set(tb.subConn("a1"), connectivity.Connecting)
+	tb.set(tb.subConn("b1"), connectivity.Ready)
+	p := tb.build()
+
+	if _, err := pick(p, "a"); err != balancer.ErrNoSubConnAvailable {
+		t.Errorf("pick of connecting tenant a: %v, want %v", err, balancer.ErrNoSubConnAvailable)
+	}
+	if addr, err := pick(p, "b"); err != nil || addr != "b1" {
+		t.Errorf("pick of tenant b: %s, %v, want b1", addr, err)
+	}
+	// no address of tenant c, fall back to any
+	if addr, err := pick(p, "c"); err != nil || addr != "b1" {
+		t.Errorf("pick of tenant c: %s, %v, want b1", addr, err)
+	}
+
+	tb.set(tb.subConn("a1"), connectivity.Ready)
+	if addr, err := pick(tb.build(), "a"); err != nil || addr != "a1" {
+		t.Errorf("pick of ready tenant a: %s, %v, want a1", addr, err)
+	}
+}
+
+func TestPickFallsBackOnFailure(t *testing.T) {
+	for _, c := range []struct {
+		fallback string
+		want     string
+		code     codes.Code
+	}{
+		{fallbackAny, "b1", codes.OK},
+		{fallbackFail, "", codes.Unavailable},
+	} {
+		config := `{"selectors": [{"header": "x-tenant", "meta": "tenant"}], "fallback": "` + c.fallback + `"}`
+		tb := newTestBalancer(t, config, map[string]string{"a1": "a", "a2": "a", "b1": "b"})
+		a1, a2 := tb.subConn("a1"), tb.subConn("a2")
+		tb.set(a1, connectivity.Connecting)
+		tb.set(a2, connectivity.Connecting)
+		tb.set(tb.subConn("b1"), connectivity.Ready)
+		// the base balancer doesn't rebuild the picker when a SubConn goes
+		// from CONNECTING to TRANSIENT_FAILURE, the picks see the states
+		p := tb.build()
+
+		tb.set(a1, connectivity.TransientFailure)
+		if _, err := pick(p, "a"); err != balancer.ErrNoSubConnAvailable {
+			t.Errorf("%s: pick while a2 is connecting: %v, want %v", c.fallback, err, balancer.ErrNoSubConnAvailable)
+		}
+
+		// all of tenant a failed, and a1 retrying stays in TRANSIENT_FAILURE
+		tb.set(a2, connectivity.TransientFailure)
+		tb.set(a1, connectivity.Idle)
+		tb.set(a1, connectivity.Connecting)
+		addr, err := pick(p, "a")
+		if addr != c.want || status.Code(err) != c.code {
+			t.Errorf("%s: pick of failed tenant a: %s, %v, want %s with code %v", c.fallback, addr, err, c.want, c.code)
+		}
+	}
+}
+
+func TestFailedSubsetDoesNotHang(t *testing.T) {
+	up := &testutil.Backend{Addr: "b1", Meta: map[string]string{"tenant": "b"}}
+	down := &testutil.Backend{Addr: "a1", Meta: map[string]string{"tenant": "a"}, Down: true}
+	cc := testutil.Dial(t, `{"subset": {"selectors": [{"header": "x-tenant", "meta": "tenant"}], "fallback": "fail"}}`, up, down)
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-tenant", "b")
+	if err := testutil.CallContext(ctx, cc); err != nil {
+		t.Fatalf("request of tenant b: %v", err)
+	}
+
+	// the request fails fast once a1 is in TRANSIENT_FAILURE, instead of
+	// waiting until its deadline
+	start := time.Now()
+	ctx = metadata.AppendToOutgoingContext(context.Background(), "x-tenant", "a")
+	if err := testutil.CallContext(ctx, cc); status.Code(err) != codes.Unavailable || time.Since(start) > time.Second {
+		t.Errorf("request of tenant a: %v after %v, want Unavailable", err, time.Since(start))
+	}
+}
@@ -12,7 +12,9 @@ import (
 	grpc_retry "github.com/grpc-ecosystem/go-grpc-middleware/retry"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
 
+	"github.com/dodoZeng/grpclb/balancer/ketama"
 	balancer "github.com/dodoZeng/grpclb/balancer/robin"
 	//balancer "github.com/dodoZeng/grpclb/balancer/ketama"
 	pb "github.com/dodoZeng/grpclb/examples/helloworld"
@@ -30,7 +32,7 @@ func main() {
 	conn, err := grpc.Dial(
 		fmt.Sprintf("consul:///%s/%s", consulAddress, service),
 		//grpc.WithBlock(),
-		grpc.WithInsecure(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
 		grpc.WithUnaryInterceptor(
 			grpc_retry.UnaryClientInterceptor(
 				// 重试次数
@@ -43,7 +45,7 @@ func main() {
 				grpc_retry.WithCodes(codes.ResourceExhausted, codes.Unavailable, codes.DeadlineExceeded),
 			),
 		),
-		grpc.WithBalancerName(balancer.BalancerName),
+		grpc.WithDefaultServiceConfig(fmt.Sprintf(`{"loadBalancingConfig": [{"%s": {}}]}`, balancer.BalancerName)),
 		//grpc.WithBalancer(grpc.RoundRobin(grpclb.NewResolver(
 		//	consulAddress, service,
 		//))),
@@ -77,7 +79,7 @@ func main() {
 
 			ctx := context.Background()
 			r, err := c.SayHello(
-				context.WithValue(ctx, "balancer.Key", key),
+				ketama.WithKey(ctx, key),
 				&pb.HelloRequest{Name: name},
 				grpc_retry.WithMax(3),
 				grpc_retry.WithPerRetryTimeout(time.Duration(300)*time.Millisecond),
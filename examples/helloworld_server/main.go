@@ -5,14 +5,15 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"strconv"
 
-	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
 	"google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/reflection"
 
@@ -28,7 +29,6 @@ var (
 	service_pre  = "helloworld"
 	service_name = "Greeter"
 	weight       = "1"
-	hash         = "10"
 )
 
 // server is used to implement helloworld.GreeterServer.
@@ -40,19 +40,6 @@ func (s *greeter_server) SayHello(ctx context.Context, in *pb.HelloRequest) (*pb
 	return &pb.HelloReply{Message: "Hello " + in.Name + "! [reply from node: " + node_id + "]"}, nil
 }
 
-// 实现健康检查接口，提供给consul调用(也可以在注册时使用其他健康检查方式，在这里是使用grpc的健康检查)
-type health_server struct{}
-
-func (h *health_server) Check(ctx context.Context, req *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
-	return &grpc_health_v1.HealthCheckResponse{
-		Status: grpc_health_v1.HealthCheckResponse_SERVING,
-	}, nil
-}
-
-func (h *health_server) Watch(*grpc_health_v1.HealthCheckRequest, grpc_health_v1.Health_WatchServer) error {
-	return nil
-}
-
 func init() {
 	if len(os.Args) > 1 {
 		node_id = os.Args[1]
@@ -63,10 +50,6 @@ func init() {
 	if len(os.Args) > 3 {
 		weight = os.Args[3]
 	}
-	if len(os.Args) > 4 {
-		hash = os.Args[4]
-	}
-
 }
 
 func main() {
@@ -78,18 +61,37 @@ func main() {
 
 	s := grpc.NewServer()
 	pb.RegisterGreeterServer(s, &greeter_server{})
-	grpc_health_v1.RegisterHealthServer(s, &health_server{})
+
+	// 健康检查接口，提供给consul调用(也可以在注册时使用其他健康检查方式，在这里是使用grpc的健康检查)
+	// 设置为NOT_SERVING时consul中的服务会进入维护模式，可以在不停止进程的情况下摘除流量
+	service := fmt.Sprintf("%s.%s", service_pre, service_name)
+	hs := health.NewServer()
+	hs.SetServingStatus(service, grpc_health_v1.HealthCheckResponse_SERVING)
+	grpc_health_v1.RegisterHealthServer(s, hs)
 
 	// 注册服务到consul
 	serviceMeta := map[string]string{
-		"hash":   hash,   // the hash of the service node
 		"weight": weight, // the weight of the service node
 	}
-	register := consul.NewRegister(node_id, consul_addr, service_pre, service_name, addr, port, nil, serviceMeta, 0, 0)
+	register, err := consul.NewRegistrar(
+		consul.WithConsulAddr(consul_addr),
+		consul.WithID(node_id),
+		consul.WithName(service),
+		consul.WithAddress(addr),
+		consul.WithPort(port),
+		consul.WithMeta(serviceMeta),
+		consul.WithHealthServer(hs, service),
+	)
+	if err != nil {
+		log.Fatalf("failed to create register: %v", err)
+		return
+	}
 	if err := register.Register(); err != nil {
 		log.Fatalf("failed to register: %v", err)
 		return
 	}
+	// 收到SIGINT/SIGTERM时先从consul注销，再优雅停止服务
+	register.GracefulStopOnSignal(s)
 
 	// Register reflection service on gRPC server.
 	reflection.Register(s)
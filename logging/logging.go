@@ -0,0 +1,86 @@
+// Package logging provides the component loggers of grpclb, which write to
+// the logger of grpclog with the name of the component as prefix.
+package logging
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"google.golang.org/grpc/grpclog"
+)
+
+// verbosity is the verbosity level set by SetVerbosity, a negative one
+// follows the level of grpclog.
+var verbosity int32 = -1
+
+// SetVerbosity sets the verbosity level of the components, the verbose logs
+// of level l are written if l <= level, such as the picks of the balancers
+// at level 2. By default it follows GRPC_GO_LOG_VERBOSITY_LEVEL of grpclog,
+// a negative level restores the default.
+func SetVerbosity(level int) {
+	atomic.StoreInt32(&verbosity, int32(level))
+}
+
+// Component returns the logger of the component.
+func Component(name string) grpclog.LoggerV2 {
+	return &componentLogger{prefix: "[" + name + "]"}
+}
+
+type componentLogger struct {
+	prefix string
+}
+
+func (c *componentLogger) Info(args ...interface{}) {
+	grpclog.Info(c.prefix + " " + fmt.Sprint(args...))
+}
+
+func (c *componentLogger) Infoln(args ...interface{}) {
+	grpclog.Info(c.prefix + " " + fmt.Sprintln(args...))
+}
+
+func (c *componentLogger) Infof(format string, args ...interface{}) {
+	grpclog.Info(c.prefix + " " + fmt.Sprintf(format, args...))
+}
+
+func (c *componentLogger) Warning(args ...interface{}) {
+	grpclog.Warning(c.prefix + " " + fmt.Sprint(args...))
+}
+
+func (c *componentLogger) Warningln(args ...interface{}) {
+	grpclog.Warning(c.prefix + " " + fmt.Sprintln(args...))
+}
+
+func (c *componentLogger) Warningf(format string, args ...interface{}) {
+	grpclog.Warning(c.prefix + " " + fmt.Sprintf(format, args...))
+}
+
+func (c *componentLogger) Error(args ...interface{}) {
+	grpclog.Error(c.prefix + " " + fmt.Sprint(args...))
+}
+
+func (c *componentLogger) Errorln(args ...interface{}) {
+	grpclog.Error(c.prefix + " " + fmt.Sprintln(args...))
+}
+
+func (c *componentLogger) Errorf(format string, args ...interface{}) {
+	grpclog.Error(c.prefix + " " + fmt.Sprintf(format, args...))
+}
+
+func (c *componentLogger) Fatal(args ...interface{}) {
+	grpclog.Fatal(c.prefix + " " + fmt.Sprint(args...))
+}
+
+func (c *componentLogger) Fatalln(args ...interface{}) {
+	grpclog.Fatal(c.prefix + " " + fmt.Sprintln(args...))
+}
+
+func (c *componentLogger) Fatalf(format string, args ...interface{}) {
+	grpclog.Fatal(c.prefix + " " + fmt.Sprintf(format, args...))
+}
+
+func (c *componentLogger) V(l int) bool {
+	if v := atomic.LoadInt32(&verbosity); v >= 0 {
+		return l <= int(v)
+	}
+	return grpclog.V(l)
+}
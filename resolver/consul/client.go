@@ -0,0 +1,134 @@
+package consul
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"time"
+
+	consul_api "github.com/hashicorp/consul/api"
+	"google.golang.org/grpc/backoff"
+)
+
+// ClientConfig holds the credentials and transport settings used to talk to
+// consul. Empty fields keep the values of consul_api.DefaultConfig, which
+// reads CONSUL_HTTP_TOKEN, CONSUL_HTTP_TOKEN_FILE, CONSUL_HTTP_AUTH,
+// CONSUL_HTTP_SSL, CONSUL_CACERT, CONSUL_CLIENT_CERT, CONSUL_CLIENT_KEY,
+// CONSUL_TLS_SERVER_NAME and CONSUL_NAMESPACE from the environment.
+type ClientConfig struct {
+	// Scheme is the URI scheme of the consul agent, "http" or "https".
+	Scheme string
+	// Token is the ACL token sent with every request.
+	Token string
+	// TokenFile is a file to read the ACL token from.
+	TokenFile string
+	// Namespace is the default namespace of the requests.
+	Namespace string
+	// HttpAuth is the basic auth of the consul agent.
+	HttpAuth *consul_api.HttpBasicAuth
+	// TLS is the CA, client certificate and key used for HTTPS/mTLS.
+	TLS consul_api.TLSConfig
+
+	// skipVerify is tls_skip_verify of the target, which turns
+	// TLS.InsecureSkipVerify of the builder and the environment off as well.
+	skipVerify *bool
+}
+
+func (c *ClientConfig) apply(config *consul_api.Config) {
+	if len(c.Scheme) > 0 {
+		config.Scheme = c.Scheme
+	}
+	if len(c.Token) > 0 {
+		config.Token = c.Token
+	}
+	if len(c.TokenFile) > 0 {
+		config.TokenFile = c.TokenFile
+	}
+	if len(c.Namespace) > 0 {
+		config.Namespace = c.Namespace
+	}
+	if c.HttpAuth != nil {
+		config.HttpAuth = c.HttpAuth
+	}
+
+	tls := &config.TLSConfig
+	if len(c.TLS.Address) > 0 {
+		tls.Address = c.TLS.Address
+	}
+	if len(c.TLS.CAFile) > 0 {
+		tls.CAFile = c.TLS.CAFile
+	}
+	if len(c.TLS.CAPath) > 0 {
+		tls.CAPath = c.TLS.CAPath
+	}
+	if len(c.TLS.CAPem) > 0 {
+		tls.CAPem = c.TLS.CAPem
+	}
+	if len(c.TLS.CertFile) > 0 {
+		tls.CertFile = c.TLS.CertFile
+	}
+	if len(c.TLS.CertPEM) > 0 {
+		tls.CertPEM = c.TLS.CertPEM
+	}
+	if len(c.TLS.KeyFile) > 0 {
+		tls.KeyFile = c.TLS.KeyFile
+	}
+	if len(c.TLS.KeyPEM) > 0 {
+		tls.KeyPEM = c.TLS.KeyPEM
+	}
+	if c.TLS.InsecureSkipVerify {
+		tls.InsecureSkipVerify = true
+	}
+	if c.skipVerify != nil {
+		tls.InsecureSkipVerify = *c.skipVerify
+	}
+}
+
+// newClient creates a consul client for the agent at addr, the returned
+// transport is owned by the client and could be closed with it.
+func newClient(addr string, c ClientConfig) (*consul_api.Client, *http.Transport, error) {
+	config := consul_api.DefaultConfig()
+	if len(addr) > 0 {
+		config.Address = addr
+	}
+	c.apply(config)
+
+	// NewClient turns InsecureSkipVerify on again if it is set in the
+	// environment, the transport keeps the TLS config set up here instead
+	if c.skipVerify != nil {
+		tlsConfig, err := consul_api.SetupTLSConfig(&config.TLSConfig)
+		if err != nil {
+			return nil, nil, err
+		}
+		config.Transport.TLSClientConfig = tlsConfig
+	}
+
+	client, err := consul_api.NewClient(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, config.Transport, nil
+}
+
+// isNotFound reports whether err is a 404 response of consul.
+func isNotFound(err error) bool {
+	var serr consul_api.StatusError
+	return errors.As(err, &serr) && serr.Code == http.StatusNotFound
+}
+
+// backoffDelay returns the exponential backoff with jitter for the retries.
+func backoffDelay(bc backoff.Config, retries int) time.Duration {
+	delay, max := float64(bc.BaseDelay), float64(bc.MaxDelay)
+	for delay < max && retries > 0 {
+		delay *= bc.Multiplier
+		retries--
+	}
+	if delay > max {
+		delay = max
+	}
+	delay *= 1 + bc.Jitter*(rand.Float64()*2-1)
+	if delay < 0 {
+		return 0
+	}
+	return time.Duration(delay)
+}
@@ -0,0 +1,142 @@
+package consul
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	consul_api "github.com/hashicorp/consul/api"
+	"google.golang.org/grpc/resolver"
+)
+
+// resolveTLS resolves the service of the TLS server srv, and returns the
+// headers of the first query, or the error reported by the resolver.
+func resolveTLS(t *testing.T, srv *httptest.Server, f *fakeConsul, c ClientConfig, query string) (http.Header, error) {
+	t.Helper()
+	cc := newFakeClientConn()
+	target := "consul://" + strings.TrimPrefix(srv.URL, "https://") + "/svc?scheme=https" + query
+	r, err := NewBuilder(WithClientConfig(c)).Build(parseURL(t, target), cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	select {
+	case <-cc.states:
+		return f.requestHeaders()[0], nil
+	case err := <-cc.errs:
+		return nil, err
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the resolver")
+	}
+	return nil, nil
+}
+
+func newTLSConsul(t *testing.T) (*httptest.Server, *fakeConsul, string) {
+	f := newFakeConsul()
+	f.set(entry("a", "127.0.0.1", 1))
+	srv := httptest.NewTLSServer(f)
+	t.Cleanup(srv.Close)
+
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	block := &pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}
+	if err := os.WriteFile(ca, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return srv, f, ca
+}
+
+func TestClientTLS(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		env    map[string]string
+		config func(ca string) ClientConfig
+		query  func(ca string) string
+		ok     bool
+	}{
+		{name: "untrusted"},
+		{name: "ca_file in target", query: func(ca string) string { return "&ca_file=" + ca }, ok: true},
+		{name: "ca file of builder", config: func(ca string) ClientConfig {
+			return ClientConfig{TLS: consul_api.TLSConfig{CAFile: ca}}
+		}, ok: true},
+		{name: "ca file in environment", env: map[string]string{"CONSUL_CACERT": "%ca"}, ok: true},
+		{name: "tls_skip_verify in target", query: func(string) string { return "&tls_skip_verify=true" }, ok: true},
+		{name: "skip verify of builder", config: func(string) ClientConfig {
+			return ClientConfig{TLS: consul_api.TLSConfig{InsecureSkipVerify: true}}
+		}, ok: true},
+		{name: "skip verify in environment", env: map[string]string{"CONSUL_HTTP_SSL_VERIFY": "false"}, ok: true},
+		// the target turns skip verify off as well
+		{name: "tls_skip_verify=false in target over builder", config: func(string) ClientConfig {
+			return ClientConfig{TLS: consul_api.TLSConfig{InsecureSkipVerify: true}}
+		}, query: func(string) string { return "&tls_skip_verify=false" }},
+		{name: "tls_skip_verify=false in target over environment", env: map[string]string{"CONSUL_HTTP_SSL_VERIFY": "false"},
+			query: func(string) string { return "&tls_skip_verify=false" }},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			srv, f, ca := newTLSConsul(t)
+			for k, v := range c.env {
+				t.Setenv(k, strings.ReplaceAll(v, "%ca", ca))
+			}
+			var config ClientConfig
+			if c.config != nil {
+				config = c.config(ca)
+			}
+			var query string
+			if c.query != nil {
+				query = c.query(ca)
+			}
+
+			_, err := resolveTLS(t, srv, f, config, query)
+			if c.ok && err != nil {
+				t.Fatalf("resolve: %v", err)
+			} else if !c.ok && err == nil {
+				t.Fatal("resolved with an untrusted certificate")
+			}
+		})
+	}
+}
+
+func TestClientCredentials(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		env    map[string]string
+		config ClientConfig
+		query  string
+		token  string
+		user   string
+		pass   string
+	}{
+		{name: "target", query: "&token=t1&http_auth=u1:p1", token: "t1", user: "u1", pass: "p1"},
+		{name: "builder", config: ClientConfig{Token: "t2", HttpAuth: &consul_api.HttpBasicAuth{Username: "u2", Password: "p2"}},
+			token: "t2", user: "u2", pass: "p2"},
+		{name: "environment", env: map[string]string{"CONSUL_HTTP_TOKEN": "t3", "CONSUL_HTTP_AUTH": "u3:p3"},
+			token: "t3", user: "u3", pass: "p3"},
+		{name: "target over builder over environment", env: map[string]string{"CONSUL_HTTP_TOKEN": "t3"},
+			config: ClientConfig{Token: "t2", HttpAuth: &consul_api.HttpBasicAuth{Username: "u2"}},
+			query:  "&token=t1&http_auth=u1", token: "t1", user: "u1"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			srv, f, _ := newTLSConsul(t)
+			for k, v := range c.env {
+				t.Setenv(k, v)
+			}
+
+			h, err := resolveTLS(t, srv, f, c.config, c.query+"&tls_skip_verify=true")
+			if err != nil {
+				t.Fatalf("resolve: %v", err)
+			}
+			if token := h.Get("X-Consul-Token"); token != c.token {
+				t.Errorf("token %q, want %q", token, c.token)
+			}
+			user, pass, _ := (&http.Request{Header: h}).BasicAuth()
+			if user != c.user || pass != c.pass {
+				t.Errorf("basic auth %q:%q, want %q:%q", user, pass, c.user, c.pass)
+			}
+		})
+	}
+}
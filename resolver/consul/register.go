@@ -1,83 +1,332 @@
 package consul
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	consul_api "github.com/hashicorp/consul/api"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/health"
 )
 
-type consulRegister struct {
-	node_id          string
-	consul_addr      string
-	service_pre      string
-	service_name     string
-	tags             []string
-	meta             map[string]string
-	addr             string
-	port             int
-	deregister_after time.Duration
+const (
+	defaultCheckInterval     = 30 * time.Second
+	defaultDeregisterAfter   = 60 * time.Second
+	defaultDeregisterTimeout = 5 * time.Second
+)
+
+// Registrar registers a service to consul, and keeps it registered with the
+// health check and anti-entropy until it is deregistered.
+type Registrar struct {
+	consul_addr   string
+	client_config ClientConfig
+	reg           consul_api.AgentServiceRegistration
+
+	mu     sync.Mutex
+	client *consul_api.Client
+
+	// grpc_check registers a GRPC check against the address of the service
+	// unless there is a check in reg
+	grpc_check       bool
 	interval         time.Duration
+	deregister_after time.Duration
+
+	// ttl_check registers a TTL check instead, which is kept updated by the
+	// heartbeat with the result of health
+	ttl_check bool
+	ttl       time.Duration
+	health    HealthFunc
+
+	// health_server drives the check with the serving status of
+	// health_service
+	health_server  *health.Server
+	health_service string
+
+	// anti_entropy registers the service again when the agent forgets it
+	anti_entropy       bool
+	reregister_backoff backoff.Config
+	reregister_hook    func(ReregisterEvent)
+	reregistrations    uint64
+
+	// loop_cancel stops the heartbeat and anti-entropy loops
+	loop_cancel context.CancelFunc
+	loop_wg     sync.WaitGroup
+}
+
+// NewRegistrar creates a register of the service described by opts, it
+// returns an error if the options are invalid.
+func NewRegistrar(opts ...Option) (*Registrar, error) {
+	r := newRegister(opts...)
+	if err := r.validate(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// NewRegister creates a register of the service service_pre.service with a
+// GRPC check. Like NewRegistrar, it registers the service again when the
+// agent forgets it, until Deregister is called.
+//
+// Deprecated: use NewRegistrar.
+func NewRegister(node_id string, consul_addr string, service_pre string, service string, addr string, port int, tags []string, meta_map map[string]string, deregister_after_second uint, interval_second uint) *Registrar {
+	deregister_after, interval := defaultDeregisterAfter, defaultCheckInterval
+	if deregister_after_second > 0 {
+		deregister_after = time.Duration(deregister_after_second) * time.Second
+	}
+	if interval_second > 0 {
+		interval = time.Duration(interval_second) * time.Second
+	}
+
+	return newRegister(
+		WithConsulAddr(consul_addr),
+		WithID(node_id),
+		WithName(fmt.Sprintf("%s.%s", service_pre, service)),
+		WithAddress(addr),
+		WithPort(port),
+		WithTags(tags...),
+		WithMeta(meta_map),
+		WithGRPCCheck(interval, deregister_after),
+	)
+}
+
+func newRegister(opts ...Option) *Registrar {
+	r := &Registrar{
+		grpc_check:         true,
+		interval:           defaultCheckInterval,
+		deregister_after:   defaultDeregisterAfter,
+		anti_entropy:       true,
+		reregister_backoff: backoff.DefaultConfig,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
 }
 
-func NewRegister(node_id string, consul_addr string, service_pre string, service string, addr string, port int, tags []string, meta_map map[string]string, deregister_after_second uint, interval_second uint) *consulRegister {
-	if deregister_after_second <= 0 {
-		deregister_after_second = 60
+func (r *Registrar) validate() error {
+	reg := &r.reg
+	if len(reg.Name) <= 0 {
+		return errors.New("consul: service name is required")
+	}
+	if reg.Port < 0 || reg.Port > 65535 {
+		return fmt.Errorf("consul: invalid service port %d", reg.Port)
+	}
+	if len(reg.SocketPath) > 0 && (len(reg.Address) > 0 || reg.Port > 0) {
+		return errors.New("consul: socket path can't be used with address or port")
+	}
+	if len(reg.SocketPath) > 0 && r.grpc_check && reg.Check == nil && len(reg.Checks) <= 0 {
+		// the default GRPC check dials the address and port
+		return errors.New("consul: socket path needs WithChecks or WithTTLCheck instead of the GRPC check")
+	}
+	if w := reg.Weights; w != nil && (w.Passing <= 0 || w.Warning < 0) {
+		return fmt.Errorf("consul: invalid service weights %d/%d", w.Passing, w.Warning)
+	}
+	switch reg.Kind {
+	case consul_api.ServiceKindTypical, consul_api.ServiceKindConnectProxy, consul_api.ServiceKindMeshGateway,
+		consul_api.ServiceKindTerminatingGateway, consul_api.ServiceKindIngressGateway:
+	default:
+		return fmt.Errorf("consul: unknown service kind %q", reg.Kind)
+	}
+	if reg.Kind == consul_api.ServiceKindConnectProxy && (reg.Proxy == nil || len(reg.Proxy.DestinationServiceName) <= 0) {
+		return errors.New("consul: connect proxy requires a destination service")
+	}
+	if r.ttl_check && r.ttl <= 0 {
+		return fmt.Errorf("consul: invalid check ttl %v", r.ttl)
+	}
+	if (r.grpc_check || r.ttl_check) && r.deregister_after < 0 {
+		return fmt.Errorf("consul: invalid deregister critical service after %v", r.deregister_after)
+	}
+	if r.grpc_check && reg.Check == nil && len(reg.Checks) <= 0 {
+		if r.interval <= 0 {
+			return fmt.Errorf("consul: invalid check interval %v", r.interval)
+		}
 	}
+	return nil
+}
 
-	if interval_second <= 0 {
-		interval_second = 30
+// agent returns the consul agent, the client is created on the first call.
+func (r *Registrar) agent() (*consul_api.Agent, error) {
+	if r.client == nil {
+		client, _, err := newClient(r.consul_addr, r.client_config)
+		if err != nil {
+			return nil, err
+		}
+		r.client = client
 	}
+	return r.client.Agent(), nil
+}
 
-	return &consulRegister{
-		node_id:          node_id,
-		consul_addr:      consul_addr,
-		service_pre:      service_pre,
-		service_name:     service,
-		addr:             addr,
-		port:             port,
-		tags:             tags,
-		meta:             meta_map,
-		deregister_after: time.Duration(deregister_after_second) * time.Second,
-		interval:         time.Duration(interval_second) * time.Second,
+// serviceID returns the ID of the service, which defaults to its name.
+func (r *Registrar) serviceID() string {
+	if len(r.reg.ID) <= 0 {
+		return r.reg.Name
 	}
+	return r.reg.ID
 }
 
-func (r *consulRegister) Register() error {
-	config := consul_api.DefaultConfig()
-	config.Address = r.consul_addr
-	client, err := consul_api.NewClient(config)
+// Register registers the service, and starts the heartbeat of the TTL check,
+// the anti-entropy loop and the watcher of the health server if they are
+// enabled.
+func (r *Registrar) Register() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.register(); err != nil {
+		return err
+	}
+	if r.loop_cancel == nil {
+		r.startLoops()
+	}
+	return nil
+}
+
+// startLoops starts the background loops of the register, r.mu must be held.
+func (r *Registrar) startLoops() {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.loop_cancel = cancel
+
+	if r.ttl_check {
+		r.loop_wg.Add(1)
+		go r.heartbeat(ctx)
+	}
+	if r.anti_entropy {
+		r.loop_wg.Add(1)
+		go r.watchService(ctx)
+	}
+	if r.health_server != nil {
+		r.loop_wg.Add(1)
+		go r.watchHealth(ctx)
+	}
+}
+
+// stopLoops stops the background loops and waits for them to exit.
+func (r *Registrar) stopLoops() {
+	r.mu.Lock()
+	cancel := r.loop_cancel
+	r.loop_cancel = nil
+	r.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		r.loop_wg.Wait()
+	}
+}
+
+func (r *Registrar) register() error {
+	agent, err := r.agent()
 	if err != nil {
 		return err
 	}
-	agent := client.Agent()
 
-	if len(r.addr) <= 0 {
-		r.addr = localIP()
+	if len(r.reg.Address) <= 0 && len(r.reg.SocketPath) <= 0 {
+		r.reg.Address = localIP()
 	}
 
-	reg := &consul_api.AgentServiceRegistration{
-		ID:      r.node_id,
-		Name:    fmt.Sprintf("%s.%s", r.service_pre, r.service_name),
-		Tags:    r.tags,
-		Port:    r.port,
-		Address: r.addr,
-		Meta:    r.meta,
-		Check: &consul_api.AgentServiceCheck{
+	reg := r.reg
+	if r.grpc_check && reg.Check == nil && len(reg.Checks) <= 0 {
+		reg.Check = &consul_api.AgentServiceCheck{
 			Interval:                       r.interval.String(),
-			GRPC:                           fmt.Sprintf("%s:%d/%s.%s", r.addr, r.port, r.service_pre, r.service_name),
+			GRPC:                           fmt.Sprintf("%s:%d/%s", reg.Address, reg.Port, reg.Name),
 			DeregisterCriticalServiceAfter: r.deregister_after.String(),
-		},
+		}
+	} else if r.ttl_check {
+		reg.Check = &consul_api.AgentServiceCheck{
+			CheckID:                        r.ttlCheckID(),
+			TTL:                            r.ttl.String(),
+			DeregisterCriticalServiceAfter: r.deregister_after.String(),
+		}
 	}
 
-	if err := agent.ServiceRegister(reg); err != nil {
+	if err := agent.ServiceRegister(&reg); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// Deregister stops the background loops and removes the service from the
+// consul agent.
+func (r *Registrar) Deregister(ctx context.Context) error {
+	r.stopLoops()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	agent, err := r.agent()
+	if err != nil {
+		return err
+	}
+
+	return agent.ServiceDeregisterOpts(r.serviceID(), r.queryOptions(ctx))
+}
+
+// queryOptions returns the query options in the namespace and partition of
+// the service.
+func (r *Registrar) queryOptions(ctx context.Context) *consul_api.QueryOptions {
+	q := &consul_api.QueryOptions{
+		Namespace: r.reg.Namespace,
+		Partition: r.reg.Partition,
+	}
+	return q.WithContext(ctx)
+}
+
+// Run registers the service, waits for ctx to be done and then deregisters
+// the service.
+func (r *Registrar) Run(ctx context.Context) error {
+	if err := r.Register(); err != nil {
+		return err
+	}
+
+	<-ctx.Done()
+
+	dctx, cancel := context.WithTimeout(context.Background(), defaultDeregisterTimeout)
+	defer cancel()
+	return r.Deregister(dctx)
+}
+
+// GracefulStopOnSignal deregisters the service and then gracefully stops s
+// when one of sigs is received, SIGINT and SIGTERM by default. Deregistering
+// first makes the clients drain the instance before its listeners close.
+// The returned function stops watching the signals.
+func (r *Registrar) GracefulStopOnSignal(s *grpc.Server, sigs ...os.Signal) (stop func()) {
+	if len(sigs) <= 0 {
+		sigs = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+	}
+
+	ch := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(ch, sigs...)
+
+	go func() {
+		defer signal.Stop(ch)
+		select {
+		case <-ch:
+		case <-done:
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), defaultDeregisterTimeout)
+		if err := r.Deregister(ctx); err != nil {
+			logger.Warningf("failed to deregister service %s before stopping: %v", r.serviceID(), err)
+		}
+		cancel()
+		s.GracefulStop()
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
 func localIP() string {
 	addrs, err := net.InterfaceAddrs()
 	if err != nil {
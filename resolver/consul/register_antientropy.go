@@ -0,0 +1,102 @@
+package consul
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// ReregisterEvent describes an attempt to register the service again after
+// the agent has forgotten it.
+type ReregisterEvent struct {
+	ServiceID string
+	// Attempt is the number of the consecutive attempts, starting from 1.
+	Attempt int
+	// Err is the error of the attempt, nil if the service is registered again.
+	Err error
+}
+
+// Reregistrations returns how many times the service has been registered
+// again since it was created.
+func (r *Registrar) Reregistrations() uint64 {
+	return atomic.LoadUint64(&r.reregistrations)
+}
+
+// reregister registers the service again, r.mu must not be held.
+func (r *Registrar) reregister(attempt int) error {
+	r.mu.Lock()
+	err := r.register()
+	r.mu.Unlock()
+
+	if err == nil {
+		atomic.AddUint64(&r.reregistrations, 1)
+		logger.Infof("service %s was missing from the agent, registered it again", r.serviceID())
+	}
+	if r.reregister_hook != nil {
+		r.reregister_hook(ReregisterEvent{ServiceID: r.serviceID(), Attempt: attempt, Err: err})
+	}
+	return err
+}
+
+// watchService keeps a blocking query on the service of the agent, and
+// registers the service again with backoff when it goes missing.
+func (r *Registrar) watchService(ctx context.Context) {
+	defer r.loop_wg.Done()
+
+	hash, retries := "", 0
+	for {
+		err := r.waitService(ctx, &hash)
+		if ctx.Err() != nil {
+			return
+		}
+
+		var delay time.Duration
+		switch {
+		case err == nil && len(hash) > 0:
+			retries = 0
+			continue
+		case err == nil:
+			// the agent doesn't support blocking queries, poll instead
+			delay = defaultCheckInterval
+		case isNotFound(err):
+			hash = ""
+			if err = r.reregister(retries + 1); err == nil {
+				retries = 0
+				continue
+			}
+			fallthrough
+		default:
+			logger.Warningf("failed to watch service %s: %v", r.serviceID(), err)
+			delay = backoffDelay(r.reregister_backoff, retries)
+			retries++
+		}
+
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// waitService waits for the service on the agent to change from hash, and
+// updates hash with the new one.
+func (r *Registrar) waitService(ctx context.Context, hash *string) error {
+	r.mu.Lock()
+	agent, err := r.agent()
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	q := r.queryOptions(ctx)
+	q.WaitHash = *hash
+	_, meta, err := agent.Service(r.serviceID(), q)
+	if err != nil {
+		return err
+	}
+	*hash = meta.LastContentHash
+	return nil
+}
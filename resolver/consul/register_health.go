@@ -0,0 +1,121 @@
+package consul
+
+import (
+	"context"
+	"time"
+
+	consul_api "github.com/hashicorp/consul/api"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// WithHealthServer ties the consul check to the serving status of service in
+// hs, the empty service is the status of the whole server. With a TTL check
+// the status is reported by the heartbeat as soon as it changes, otherwise
+// the service is put into the maintenance mode of consul while it is not
+// serving. So an instance could be drained by hs.SetServingStatus or
+// hs.Shutdown without stopping the process.
+func WithHealthServer(hs *health.Server, service string) Option {
+	return func(r *Registrar) {
+		r.health_server = hs
+		r.health_service = service
+	}
+}
+
+// checkHealth returns the status and output of the TTL check.
+func (r *Registrar) checkHealth() (status string, output string) {
+	if r.health != nil {
+		return r.health()
+	}
+	if r.health_server != nil {
+		resp, err := r.health_server.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{Service: r.health_service})
+		if err != nil {
+			return consul_api.HealthCritical, err.Error()
+		}
+		return servingStatusHealth(resp.Status), resp.Status.String()
+	}
+	return consul_api.HealthPassing, ""
+}
+
+func servingStatusHealth(s grpc_health_v1.HealthCheckResponse_ServingStatus) string {
+	if s == grpc_health_v1.HealthCheckResponse_SERVING {
+		return consul_api.HealthPassing
+	}
+	return consul_api.HealthCritical
+}
+
+// watchHealth watches the serving status in the health server, and applies
+// it to consul with backoff.
+func (r *Registrar) watchHealth(ctx context.Context) {
+	defer r.loop_wg.Done()
+
+	stream := &healthWatchStream{
+		ctx:      ctx,
+		statuses: make(chan grpc_health_v1.HealthCheckResponse_ServingStatus, 1),
+	}
+	r.loop_wg.Add(1)
+	go func() {
+		defer r.loop_wg.Done()
+		r.health_server.Watch(&grpc_health_v1.HealthCheckRequest{Service: r.health_service}, stream)
+	}()
+
+	var status grpc_health_v1.HealthCheckResponse_ServingStatus
+	var retry <-chan time.Time
+	retries := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case status = <-stream.statuses:
+			retries = 0
+		case <-retry:
+		}
+
+		retry = nil
+		if err := r.applyServingStatus(ctx, status); err != nil && ctx.Err() == nil {
+			logger.Warningf("failed to apply serving status %v of service %s: %v", status, r.serviceID(), err)
+			retry = time.After(backoffDelay(r.reregister_backoff, retries))
+			retries++
+		}
+	}
+}
+
+func (r *Registrar) applyServingStatus(ctx context.Context, status grpc_health_v1.HealthCheckResponse_ServingStatus) error {
+	if r.ttl_check {
+		return r.updateTTL(ctx)
+	}
+
+	r.mu.Lock()
+	agent, err := r.agent()
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if status == grpc_health_v1.HealthCheckResponse_SERVING {
+		return agent.DisableServiceMaintenanceOpts(r.serviceID(), r.queryOptions(ctx))
+	}
+	return agent.EnableServiceMaintenanceOpts(r.serviceID(), "grpc serving status "+status.String(), r.queryOptions(ctx))
+}
+
+// healthWatchStream is an in-process stream of health.Server.Watch, which
+// keeps only the latest status.
+type healthWatchStream struct {
+	grpc.ServerStream
+	ctx      context.Context
+	statuses chan grpc_health_v1.HealthCheckResponse_ServingStatus
+}
+
+func (s *healthWatchStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *healthWatchStream) Send(resp *grpc_health_v1.HealthCheckResponse) error {
+	select {
+	case <-s.statuses:
+	default:
+	}
+	s.statuses <- resp.Status
+	return nil
+}
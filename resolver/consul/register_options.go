@@ -0,0 +1,203 @@
+package consul
+
+import (
+	"time"
+
+	consul_api "github.com/hashicorp/consul/api"
+	"google.golang.org/grpc/backoff"
+)
+
+// Option configures the register created by NewRegistrar.
+type Option func(*Registrar)
+
+// WithConsulAddr sets the address of the consul agent.
+func WithConsulAddr(addr string) Option {
+	return func(r *Registrar) {
+		r.consul_addr = addr
+	}
+}
+
+// WithClient sets the consul credentials and TLS settings.
+func WithClient(c ClientConfig) Option {
+	return func(r *Registrar) {
+		r.client_config = c
+	}
+}
+
+// WithRegistration uses reg as the base of the registration, it replaces the
+// fields set by the options before it.
+func WithRegistration(reg consul_api.AgentServiceRegistration) Option {
+	return func(r *Registrar) {
+		r.reg = reg
+	}
+}
+
+// WithID sets the service ID, it defaults to the service name.
+func WithID(id string) Option {
+	return func(r *Registrar) {
+		r.reg.ID = id
+	}
+}
+
+// WithName sets the service name, which is the service of the consul target.
+func WithName(name string) Option {
+	return func(r *Registrar) {
+		r.reg.Name = name
+	}
+}
+
+// WithKind sets the service kind.
+func WithKind(kind consul_api.ServiceKind) Option {
+	return func(r *Registrar) {
+		r.reg.Kind = kind
+	}
+}
+
+// WithAddress sets the service address, it defaults to the first non-loopback
+// IPv4 address of the host.
+func WithAddress(addr string) Option {
+	return func(r *Registrar) {
+		r.reg.Address = addr
+	}
+}
+
+// WithPort sets the service port.
+func WithPort(port int) Option {
+	return func(r *Registrar) {
+		r.reg.Port = port
+	}
+}
+
+// WithSocketPath sets the unix socket path of the service, instead of the
+// address and port. The default GRPC check can't reach it, so it needs
+// WithChecks or WithTTLCheck.
+func WithSocketPath(path string) Option {
+	return func(r *Registrar) {
+		r.reg.SocketPath = path
+	}
+}
+
+// WithTaggedAddresses sets the tagged addresses of the service, such as
+// "lan" and "wan".
+func WithTaggedAddresses(addrs map[string]consul_api.ServiceAddress) Option {
+	return func(r *Registrar) {
+		r.reg.TaggedAddresses = addrs
+	}
+}
+
+// WithTags sets the service tags.
+func WithTags(tags ...string) Option {
+	return func(r *Registrar) {
+		r.reg.Tags = tags
+	}
+}
+
+// WithEnableTagOverride allows the tags to be updated by external agents.
+func WithEnableTagOverride(enable bool) Option {
+	return func(r *Registrar) {
+		r.reg.EnableTagOverride = enable
+	}
+}
+
+// WithMeta sets the service meta.
+func WithMeta(meta map[string]string) Option {
+	return func(r *Registrar) {
+		r.reg.Meta = meta
+	}
+}
+
+// WithWeights sets the DNS weights of the service in passing and warning
+// state.
+func WithWeights(passing, warning int) Option {
+	return func(r *Registrar) {
+		r.reg.Weights = &consul_api.AgentWeights{Passing: passing, Warning: warning}
+	}
+}
+
+// WithConnect sets the connect settings of the service.
+func WithConnect(connect *consul_api.AgentServiceConnect) Option {
+	return func(r *Registrar) {
+		r.reg.Connect = connect
+	}
+}
+
+// WithProxy sets the proxy settings of a connect-proxy service.
+func WithProxy(proxy *consul_api.AgentServiceConnectProxyConfig) Option {
+	return func(r *Registrar) {
+		r.reg.Proxy = proxy
+	}
+}
+
+// WithNamespace sets the namespace of the service.
+func WithNamespace(ns string) Option {
+	return func(r *Registrar) {
+		r.reg.Namespace = ns
+	}
+}
+
+// WithPartition sets the admin partition of the service.
+func WithPartition(partition string) Option {
+	return func(r *Registrar) {
+		r.reg.Partition = partition
+	}
+}
+
+// WithGRPCCheck sets the interval of the default GRPC check and the timeout
+// after which a critical service is deregistered.
+func WithGRPCCheck(interval, deregister_after time.Duration) Option {
+	return func(r *Registrar) {
+		r.grpc_check = true
+		r.ttl_check = false
+		r.interval = interval
+		r.deregister_after = deregister_after
+	}
+}
+
+// WithChecks replaces the default GRPC check with checks.
+func WithChecks(checks ...*consul_api.AgentServiceCheck) Option {
+	return func(r *Registrar) {
+		r.grpc_check = false
+		r.ttl_check = false
+		r.reg.Check = nil
+		r.reg.Checks = checks
+	}
+}
+
+// WithTTLCheck replaces the default GRPC check with a TTL check, which does
+// not need consul to reach the service. The heartbeat updates the check every
+// ttl/3 with the result of health. A nil health passes, or reports the
+// serving status of the health server set by WithHealthServer.
+func WithTTLCheck(ttl, deregister_after time.Duration, health HealthFunc) Option {
+	return func(r *Registrar) {
+		r.grpc_check = false
+		r.ttl_check = true
+		r.ttl = ttl
+		r.deregister_after = deregister_after
+		r.health = health
+	}
+}
+
+// WithAntiEntropy enables or disables the anti-entropy loop, which watches the
+// service on the agent and registers it again when it goes missing, such as
+// after the agent restarts. It is enabled by default.
+func WithAntiEntropy(enable bool) Option {
+	return func(r *Registrar) {
+		r.anti_entropy = enable
+	}
+}
+
+// WithReregisterBackoff sets the backoff between failed re-registrations,
+// backoff.DefaultConfig is used by default.
+func WithReregisterBackoff(bc backoff.Config) Option {
+	return func(r *Registrar) {
+		r.reregister_backoff = bc
+	}
+}
+
+// WithReregisterHook sets a hook called after every re-registration, which
+// could be used to export events or metrics.
+func WithReregisterHook(hook func(ReregisterEvent)) Option {
+	return func(r *Registrar) {
+		r.reregister_hook = hook
+	}
+}
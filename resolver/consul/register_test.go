@@ -0,0 +1,337 @@
+package consul
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	consul_api "github.com/hashicorp/consul/api"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// newTestRegistrar creates a registrar of the service svc-1 on the agent f,
+// which retries the failed re-registrations after at most 100ms.
+func newTestRegistrar(t *testing.T, f *fakeConsul, opts ...Option) *Registrar {
+	t.Helper()
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	opts = append([]Option{
+		WithConsulAddr(strings.TrimPrefix(srv.URL, "http://")),
+		WithID("svc-1"),
+		WithName("svc"),
+		WithAddress("127.0.0.1"),
+		WithPort(50051),
+		WithReregisterBackoff(backoff.Config{BaseDelay: 10 * time.Millisecond, Multiplier: 1.6, MaxDelay: 100 * time.Millisecond}),
+	}, opts...)
+	r, err := NewRegistrar(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the loops are stopped before the agent, which waits for their queries
+	t.Cleanup(r.stopLoops)
+	return r
+}
+
+// eventually waits for cond to be true.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func registered(f *fakeConsul) func() bool {
+	return func() bool {
+		reg, _ := f.service("svc-1")
+		return reg != nil
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		opts []Option
+		err  string
+	}{
+		{"minimal", []Option{WithName("svc")}, ""},
+		{"no name", []Option{WithPort(80)}, "service name is required"},
+		{"bad port", []Option{WithName("svc"), WithPort(70000)}, "invalid service port"},
+		{"socket and port", []Option{WithName("svc"), WithSocketPath("/tmp/svc.sock"), WithPort(80),
+			WithTTLCheck(time.Second, time.Minute, nil)}, "can't be used with address or port"},
+		{"socket with grpc check", []Option{WithName("svc"), WithSocketPath("/tmp/svc.sock")}, "socket path needs"},
+		{"socket with ttl check", []Option{WithName("svc"), WithSocketPath("/tmp/svc.sock"),
+			WithTTLCheck(time.Second, time.Minute, nil)}, ""},
+		{"socket with checks", []Option{WithName("svc"), WithSocketPath("/tmp/svc.sock"),
+			WithChecks(&consul_api.AgentServiceCheck{TTL: "10s"})}, ""},
+		{"bad weights", []Option{WithName("svc"), WithWeights(0, 1)}, "invalid service weights"},
+		{"unknown kind", []Option{WithName("svc"), WithKind("bogus")}, "unknown service kind"},
+		{"proxy without destination", []Option{WithName("svc"), WithKind(consul_api.ServiceKindConnectProxy)},
+			"requires a destination service"},
+		{"bad ttl", []Option{WithName("svc"), WithTTLCheck(0, time.Minute, nil)}, "invalid check ttl"},
+		{"bad deregister after", []Option{WithName("svc"), WithGRPCCheck(time.Second, -time.Second)},
+			"invalid deregister critical service after"},
+		{"bad interval", []Option{WithName("svc"), WithGRPCCheck(0, time.Minute)}, "invalid check interval"},
+	} {
+		_, err := NewRegistrar(c.opts...)
+		switch {
+		case len(c.err) == 0 && err != nil:
+			t.Errorf("%s: %v", c.name, err)
+		case len(c.err) > 0 && (err == nil || !strings.Contains(err.Error(), c.err)):
+			t.Errorf("%s: error %v, want %q", c.name, err, c.err)
+		}
+	}
+}
+
+func TestRegisterDeregister(t *testing.T) {
+	f := newFakeConsul()
+	r := newTestRegistrar(t, f, WithAntiEntropy(false))
+
+	if err := r.Register(); err != nil {
+		t.Fatal(err)
+	}
+	reg, n := f.service("svc-1")
+	if reg == nil || n != 1 {
+		t.Fatalf("service %+v after %d registrations, want it registered once", reg, n)
+	}
+	if c := reg.Check; c == nil || c.GRPC != "127.0.0.1:50051/svc" || c.Interval != "30s" || c.DeregisterCriticalServiceAfter != "1m0s" {
+		t.Errorf("check %+v, want the default GRPC check of 127.0.0.1:50051/svc", c)
+	}
+
+	if err := r.Deregister(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if registered(f)() {
+		t.Error("service is registered after Deregister")
+	}
+}
+
+func TestRun(t *testing.T) {
+	f := newFakeConsul()
+	r := newTestRegistrar(t, f)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- r.Run(ctx) }()
+	eventually(t, "the registration", registered(f))
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return after the cancellation")
+	}
+	// the anti-entropy loop is stopped, and doesn't register it again
+	time.Sleep(100 * time.Millisecond)
+	if registered(f)() {
+		t.Error("service is registered after Run returned")
+	}
+}
+
+func TestGracefulStopOnSignal(t *testing.T) {
+	f := newFakeConsul()
+	r := newTestRegistrar(t, f)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer()
+	served := make(chan struct{})
+	go func() {
+		s.Serve(lis)
+		close(served)
+	}()
+	defer s.Stop()
+
+	if err := r.Register(); err != nil {
+		t.Fatal(err)
+	}
+	stop := r.GracefulStopOnSignal(s, syscall.SIGHUP)
+	defer stop()
+
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Signal(syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server is still serving after the signal")
+	}
+	if registered(f)() {
+		t.Error("service is registered after the server stopped")
+	}
+}
+
+func TestTTLHeartbeat(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(true)
+	health := func() (string, string) {
+		if healthy.Load() {
+			return "pass", "ok"
+		}
+		return "fail", "down"
+	}
+	f := newFakeConsul()
+	r := newTestRegistrar(t, f, WithTTLCheck(300*time.Millisecond, time.Minute, health), WithAntiEntropy(false))
+
+	if err := r.Register(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Deregister(context.Background())
+	reg, _ := f.service("svc-1")
+	if c := reg.Check; c == nil || c.CheckID != "service:svc-1" || c.TTL != "300ms" || len(c.GRPC) > 0 {
+		t.Fatalf("check %+v, want the TTL check service:svc-1", c)
+	}
+	eventually(t, "the passing check", func() bool { return f.check("service:svc-1") == consul_api.HealthPassing })
+
+	healthy.Store(false)
+	eventually(t, "the critical check", func() bool { return f.check("service:svc-1") == consul_api.HealthCritical })
+
+	// the heartbeat registers the service again, the anti-entropy loop is off
+	healthy.Store(true)
+	f.forget()
+	eventually(t, "the passing check after the agent forgot it", func() bool {
+		return registered(f)() && f.check("service:svc-1") == consul_api.HealthPassing
+	})
+	if n := r.Reregistrations(); n != 1 {
+		t.Errorf("%d re-registrations, want 1", n)
+	}
+}
+
+func TestAntiEntropy(t *testing.T) {
+	f := newFakeConsul()
+	events := make(chan ReregisterEvent, 100)
+	r := newTestRegistrar(t, f, WithReregisterHook(func(e ReregisterEvent) { events <- e }))
+
+	if err := r.Register(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Deregister(context.Background())
+
+	next := func() ReregisterEvent {
+		t.Helper()
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the re-registration")
+		}
+		return ReregisterEvent{}
+	}
+
+	// the attempts count up while they fail
+	f.failRegister(true)
+	f.forget()
+	for attempt := 1; attempt <= 2; attempt++ {
+		if e := next(); e.ServiceID != "svc-1" || e.Attempt != attempt || e.Err == nil {
+			t.Fatalf("event %+v, want the failed attempt %d", e, attempt)
+		}
+	}
+	f.failRegister(false)
+	for {
+		e := next()
+		if e.Err == nil {
+			break
+		}
+	}
+	if !registered(f)() || r.Reregistrations() != 1 {
+		t.Fatalf("service registered %v after %d re-registrations, want it registered again once", registered(f)(), r.Reregistrations())
+	}
+
+	// and start from 1 again after a success
+	f.forget()
+	if e := next(); e.Attempt != 1 || e.Err != nil {
+		t.Errorf("event %+v, want the successful attempt 1", e)
+	}
+	if !registered(f)() || r.Reregistrations() != 2 {
+		t.Errorf("service registered %v after %d re-registrations, want it registered again twice", registered(f)(), r.Reregistrations())
+	}
+}
+
+func TestNewRegisterAntiEntropy(t *testing.T) {
+	f := newFakeConsul()
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	r := NewRegister("svc-1", strings.TrimPrefix(srv.URL, "http://"), "pre", "svc", "127.0.0.1", 50051, nil, nil, 0, 0)
+	if err := r.Register(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Deregister(context.Background())
+	if reg, _ := f.service("svc-1"); reg == nil || reg.Name != "pre.svc" {
+		t.Fatalf("service %+v, want pre.svc", reg)
+	}
+
+	f.forget()
+	eventually(t, "the re-registration", registered(f))
+}
+
+func TestHealthServerMaintenance(t *testing.T) {
+	f := newFakeConsul()
+	hs := health.NewServer()
+	r := newTestRegistrar(t, f, WithHealthServer(hs, ""), WithAntiEntropy(false))
+
+	if err := r.Register(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Deregister(context.Background())
+
+	inMaintenance := func() bool { return f.inMaintenance("svc-1") }
+	hs.SetServingStatus("", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	eventually(t, "the maintenance", inMaintenance)
+
+	hs.SetServingStatus("", grpc_health_v1.HealthCheckResponse_SERVING)
+	eventually(t, "the end of the maintenance", func() bool { return !inMaintenance() })
+
+	hs.Shutdown()
+	eventually(t, "the maintenance after the shutdown", inMaintenance)
+}
+
+func TestHealthServerTTL(t *testing.T) {
+	f := newFakeConsul()
+	hs := health.NewServer()
+	hs.SetServingStatus("svc", grpc_health_v1.HealthCheckResponse_SERVING)
+	// the status is reported as soon as it changes, long before the next
+	// heartbeat in 20s
+	r := newTestRegistrar(t, f, WithTTLCheck(time.Minute, time.Minute, nil), WithHealthServer(hs, "svc"), WithAntiEntropy(false))
+
+	if err := r.Register(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Deregister(context.Background())
+
+	check := func(status string) func() bool {
+		return func() bool { return f.check("service:svc-1") == status }
+	}
+	eventually(t, "the passing check", check(consul_api.HealthPassing))
+
+	hs.SetServingStatus("svc", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	eventually(t, "the critical check", check(consul_api.HealthCritical))
+	if f.inMaintenance("svc-1") {
+		t.Error("service is in maintenance with a TTL check")
+	}
+
+	hs.SetServingStatus("svc", grpc_health_v1.HealthCheckResponse_SERVING)
+	eventually(t, "the passing check again", check(consul_api.HealthPassing))
+}
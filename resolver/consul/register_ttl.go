@@ -0,0 +1,65 @@
+package consul
+
+import (
+	"context"
+	"time"
+)
+
+// HealthFunc reports the health of the service for the TTL check, status is
+// one of consul_api.HealthPassing, HealthWarning and HealthCritical (or
+// "pass", "warn" and "fail"), output is shown as the output of the check.
+type HealthFunc func() (status string, output string)
+
+func (r *Registrar) ttlCheckID() string {
+	return "service:" + r.serviceID()
+}
+
+func (r *Registrar) heartbeat(ctx context.Context) {
+	defer r.loop_wg.Done()
+
+	interval := r.ttl / 3
+	if interval <= 0 {
+		interval = r.ttl
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.updateTTL(ctx); err != nil && ctx.Err() == nil {
+			logger.Warningf("failed to update the ttl check of %s: %v", r.serviceID(), err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// updateTTL updates the TTL check with the health of the service, and
+// registers the service again if the agent has forgotten it.
+func (r *Registrar) updateTTL(ctx context.Context) error {
+	status, output := r.checkHealth()
+
+	r.mu.Lock()
+	agent, err := r.agent()
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = agent.UpdateTTLOpts(r.ttlCheckID(), output, status, r.queryOptions(ctx))
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+
+	// the agent may have lost its state, such as after a restart
+	if _, _, serr := agent.Service(r.serviceID(), r.queryOptions(ctx)); !isNotFound(serr) {
+		return err
+	}
+	if err := r.reregister(1); err != nil {
+		return err
+	}
+	return agent.UpdateTTLOpts(r.ttlCheckID(), output, status, r.queryOptions(ctx))
+}
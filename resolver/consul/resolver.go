@@ -1,32 +1,81 @@
 package consul
 
 import (
+	"context"
+	"fmt"
 	"net"
+	"net/http"
+	"sort"
 	"strconv"
-	"strings"
 	"sync"
+	"time"
 
 	consul_api "github.com/hashicorp/consul/api"
+	"google.golang.org/grpc/backoff"
 	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+
+	"github.com/dodoZeng/grpclb/attributes"
+	"github.com/dodoZeng/grpclb/logging"
 )
 
 const scheme = "consul"
 
-type consulResolverBuilder struct{}
+var logger = logging.Component(scheme)
+
+// The keys of the service Meta which are resolved to the attributes of the
+// addresses, see package attributes.
+const (
+	MetaWeight  = "weight"
+	MetaHash    = "hash"
+	MetaZone    = "zone"
+	MetaRegion  = "region"
+	MetaVersion = "version"
+)
 
-func (*consulResolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+// BuilderOption configures the consul resolver builder.
+type BuilderOption func(*consulResolverBuilder)
 
-	var addr, service string
-	if ss := strings.Split(target.Endpoint, "/"); len(ss) >= 2 {
-		addr, service = ss[0], ss[1]
-	} else {
-		addr = target.Endpoint
+// WithBackoff sets the backoff between failed consul queries,
+// backoff.DefaultConfig is used by default.
+func WithBackoff(bc backoff.Config) BuilderOption {
+	return func(b *consulResolverBuilder) {
+		b.backoff = bc
+	}
+}
+
+// WithClientConfig sets the consul credentials and TLS settings, the ones in
+// the target override them.
+func WithClientConfig(c ClientConfig) BuilderOption {
+	return func(b *consulResolverBuilder) {
+		b.client = c
+	}
+}
+
+// NewBuilder creates a consul resolver builder, it could be registered with
+// resolver.Register to replace the default one.
+func NewBuilder(opts ...BuilderOption) resolver.Builder {
+	b := &consulResolverBuilder{
+		backoff: backoff.DefaultConfig,
 	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
 
-	config := consul_api.DefaultConfig()
-	config.Address = addr
+type consulResolverBuilder struct {
+	backoff backoff.Config
+	client  ClientConfig
+}
 
-	client, err := consul_api.NewClient(config)
+func (b *consulResolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	t, err := parseTarget(target, b.client)
+	if err != nil {
+		return nil, err
+	}
+
+	client, transport, err := newClient(t.addr, t.client)
 	if err != nil {
 		return nil, err
 	}
@@ -35,8 +84,15 @@ func (*consulResolverBuilder) Build(target resolver.Target, cc resolver.ClientCo
 		target:       target,
 		cc:           cc,
 		consulClient: client,
-		addrs:        make(map[string]*consul_api.AgentService),
-		service:      service,
+		transport:    transport,
+		backoff:      b.backoff,
+		service:      t.service,
+		tags:         t.tags,
+		passing:      t.passing,
+		query:        t.query,
+	}
+	if !opts.DisableServiceConfig {
+		r.configKey = t.configKey
 	}
 	r.start()
 	return r, nil
@@ -51,67 +107,230 @@ type consulResolver struct {
 	cc     resolver.ClientConn
 
 	consulClient *consul_api.Client
-	addrs        map[string]*consul_api.AgentService
+	transport    *http.Transport
 	service      string
+	tags         []string
+	passing      bool
+	query        consul_api.QueryOptions
 	lastIndex    uint64
+	backoff      backoff.Config
+	configKey    string
+	configIndex  uint64
 
-	done bool
-	wg   sync.WaitGroup
-}
+	// mu guards the last addresses and service config, which are published
+	// together when either of them changes.
+	mu                sync.Mutex
+	lastAddrs         []resolver.Address
+	resolved          bool
+	lastServiceConfig *serviceconfig.ParseResult
+	configRead        bool
 
-func (r *consulResolver) ResolveNow(o resolver.ResolveNowOptions) {
-	r.resolveOnce(o)
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
 }
 
+// ResolveNow is a no-op, the watcher always keeps a blocking query in flight.
+func (r *consulResolver) ResolveNow(o resolver.ResolveNowOptions) {}
+
+// Close cancels the in-flight blocking queries and waits for the watchers to
+// exit.
 func (r *consulResolver) Close() {
-	r.done = true
-	//r.wg.Wait()
+	r.cancel()
+	r.wg.Wait()
+	if r.transport != nil {
+		r.transport.CloseIdleConnections()
+	}
 }
 
 func (r *consulResolver) start() {
-	r.done = false
-	go r.watchAddrUpdates()
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	r.wg.Add(1)
+	go r.watch(r.resolveOnce, r.cc.ReportError)
+	if len(r.configKey) > 0 {
+		// the service config is watched apart from the service, so that a
+		// change of the key is picked up without any change of the service,
+		// and a failed KV query doesn't hold back the addresses
+		r.wg.Add(1)
+		go r.watch(r.resolveConfigOnce, func(err error) {
+			logger.Warningf("%v", err)
+		})
+	}
 }
 
-func (r *consulResolver) watchAddrUpdates() {
-	r.wg.Add(1)
+// watch runs the blocking queries of once until the resolver is closed,
+// the failed ones are reported to onError and retried after the backoff.
+func (r *consulResolver) watch(once func() error, onError func(error)) {
 	defer r.wg.Done()
 
-	o := resolver.ResolveNowOptions{}
-	for r.done != true {
-		r.resolveOnce(o)
+	retries := 0
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		default:
+		}
+
+		if err := once(); err == nil {
+			retries = 0
+			continue
+		} else if r.ctx.Err() == nil {
+			onError(err)
+		}
+
+		t := time.NewTimer(backoffDelay(r.backoff, retries))
+		select {
+		case <-r.ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+		retries++
 	}
 }
 
-func (r *consulResolver) resolveOnce(o resolver.ResolveNowOptions) {
-	services, metainfo, err := r.consulClient.Health().Service(r.service, "", true, &consul_api.QueryOptions{
-		WaitIndex: r.lastIndex,
-	})
+func (r *consulResolver) resolveOnce() error {
+	q := r.query
+	q.WaitIndex = r.lastIndex
+	services, metainfo, err := r.consulClient.Health().ServiceMultipleTags(r.service, r.tags, r.passing, q.WithContext(r.ctx))
 	if err != nil {
-		return
+		return fmt.Errorf("consul: failed to query service %q: %v", r.service, err)
+	}
+	if r.ctx.Err() != nil {
+		return nil
+	}
+
+	// the blocking query timed out without any change
+	if r.lastIndex != 0 && metainfo.LastIndex == r.lastIndex {
+		return nil
+	}
+	// reset the index if it goes backwards, see consul blocking queries
+	if metainfo.LastIndex < r.lastIndex {
+		r.lastIndex = 0
+	} else {
+		r.lastIndex = metainfo.LastIndex
 	}
-	r.lastIndex = metainfo.LastIndex
 
 	addrs := make(map[string]*consul_api.AgentService)
 	for _, s := range services {
-		addrs[net.JoinHostPort(s.Service.Address, strconv.Itoa(s.Service.Port))] = s.Service
+		// the service address is empty if the instance is registered
+		// without one, it listens on the address of its node then
+		host := s.Service.Address
+		if len(host) == 0 && s.Node != nil {
+			host = s.Node.Address
+		}
+		addrs[net.JoinHostPort(host, strconv.Itoa(s.Service.Port))] = s.Service
+	}
+
+	// always publish the complete healthy set, so that the removed (or all)
+	// instances are drained out of the balancer as well
+	keys := make([]string, 0, len(addrs))
+	for k := range addrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	newAddrs := make([]resolver.Address, 0, len(keys))
+	for _, k := range keys {
+		newAddrs = append(newAddrs, serviceAddress(k, addrs[k]))
 	}
+	r.mu.Lock()
+	r.lastAddrs, r.resolved = newAddrs, true
+	r.updateState()
+	r.mu.Unlock()
+	return nil
+}
 
-	var newAddrs []resolver.Address
-	for k, s := range addrs {
-		if _, ok := r.addrs[k]; !ok {
-			newAddrs = append(newAddrs, resolver.Address{Addr: k, ServerName: s.ID, Metadata: s})
+// resolveConfigOnce reads the service config from the consul KV with a
+// blocking query. The config is nil if the key doesn't exist, and the
+// default service config is used.
+func (r *consulResolver) resolveConfigOnce() error {
+	q := r.query
+	q.WaitIndex = r.configIndex
+	pair, metainfo, err := r.consulClient.KV().Get(r.configKey, q.WithContext(r.ctx))
+	if err != nil {
+		// keep the last service config, and publish the addresses without
+		// it if the KV has never been read
+		r.mu.Lock()
+		if !r.configRead {
+			r.configRead = true
+			r.updateState()
 		}
+		r.mu.Unlock()
+		return fmt.Errorf("consul: failed to get service config %q: %v", r.configKey, err)
+	}
+	if r.ctx.Err() != nil {
+		return nil
 	}
-	if len(newAddrs) > 0 {
-		r.cc.NewAddress(newAddrs)
+
+	if r.configRead && metainfo.LastIndex == r.configIndex {
+		return nil
+	}
+	if metainfo.LastIndex < r.configIndex {
+		r.configIndex = 0
+	} else {
+		r.configIndex = metainfo.LastIndex
 	}
 
-	if len(addrs) != 0 {
-		r.addrs = addrs
+	var sc *serviceconfig.ParseResult
+	if pair != nil {
+		sc = r.cc.ParseServiceConfig(string(pair.Value))
+		if sc.Err != nil {
+			logger.Warningf("invalid service config %q: %v", r.configKey, sc.Err)
+		}
+	}
+
+	r.mu.Lock()
+	r.lastServiceConfig, r.configRead = sc, true
+	r.updateState()
+	r.mu.Unlock()
+	return nil
+}
+
+// updateState publishes the last addresses with the last service config,
+// once both of them have been read. r.mu must be held.
+func (r *consulResolver) updateState() {
+	if !r.resolved || (len(r.configKey) > 0 && !r.configRead) {
+		return
+	}
+	state := resolver.State{Addresses: r.lastAddrs}
+	if len(r.configKey) > 0 {
+		state.ServiceConfig = r.lastServiceConfig
+	}
+	r.cc.UpdateState(state)
+}
+
+// serviceAddress returns the address of the service with the attributes
+// read from its Meta and tags, the hash key is the service ID unless it is
+// set.
+func serviceAddress(addr string, s *consul_api.AgentService) resolver.Address {
+	a := resolver.Address{Addr: addr, ServerName: s.ID, Metadata: s}
+	if n, err := strconv.Atoi(s.Meta[MetaWeight]); err == nil {
+		a = attributes.WithWeight(a, n)
+	}
+	if hash := s.Meta[MetaHash]; len(hash) > 0 {
+		a = attributes.WithHashKey(a, hash)
+	} else if len(s.ID) > 0 {
+		a = attributes.WithHashKey(a, s.ID)
+	}
+	if zone := s.Meta[MetaZone]; len(zone) > 0 {
+		a = attributes.WithZone(a, zone)
+	}
+	if region := s.Meta[MetaRegion]; len(region) > 0 {
+		a = attributes.WithRegion(a, region)
+	}
+	if version := s.Meta[MetaVersion]; len(version) > 0 {
+		a = attributes.WithVersion(a, version)
+	}
+	if len(s.Tags) > 0 {
+		a = attributes.WithTags(a, s.Tags...)
+	}
+	if len(s.Meta) > 0 {
+		a = attributes.WithMeta(a, s.Meta)
 	}
+	return a
 }
 
 func init() {
-	resolver.Register(&consulResolverBuilder{})
+	resolver.Register(NewBuilder())
 }
@@ -0,0 +1,469 @@
+package consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	consul_api "github.com/hashicorp/consul/api"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// fakeConsul serves /v1/health/service and the service config in /v1/kv
+// with blocking queries, X-Consul-Index grows with every change of the
+// instances or of the config. It serves the services and checks of
+// /v1/agent as well, whose blocking queries wait on the hash of agentIndex.
+type fakeConsul struct {
+	mu      sync.Mutex
+	index   uint64
+	entries []*consul_api.ServiceEntry
+	changed chan struct{}
+	headers []http.Header
+
+	configIndex   uint64
+	config        *consul_api.KVPair
+	configChanged chan struct{}
+
+	agentIndex    uint64
+	agentChanged  chan struct{}
+	services      map[string]*consul_api.AgentServiceRegistration
+	registrations int
+	registerErr   bool
+	checks        map[string]string
+	maintenance   map[string]bool
+
+	// blocking and canceled are signaled when a blocking query starts to
+	// wait, and when it is canceled by the client.
+	blocking chan struct{}
+	canceled chan struct{}
+}
+
+func newFakeConsul() *fakeConsul {
+	return &fakeConsul{
+		index:         1,
+		changed:       make(chan struct{}),
+		configIndex:   1,
+		configChanged: make(chan struct{}),
+		agentIndex:    1,
+		agentChanged:  make(chan struct{}),
+		services:      make(map[string]*consul_api.AgentServiceRegistration),
+		checks:        make(map[string]string),
+		maintenance:   make(map[string]bool),
+		blocking:      make(chan struct{}, 1),
+		canceled:      make(chan struct{}, 1),
+	}
+}
+
+// set replaces the instances, and wakes the blocking queries up.
+func (f *fakeConsul) set(entries ...*consul_api.ServiceEntry) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.entries = entries
+	f.index++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// setConfig replaces the service config of key, and wakes the blocking
+// queries of the KV up.
+func (f *fakeConsul) setConfig(key, js string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.config = &consul_api.KVPair{Key: key, Value: []byte(js)}
+	f.configIndex++
+	close(f.configChanged)
+	f.configChanged = make(chan struct{})
+}
+
+// agentChange wakes the blocking queries of the agent up, f.mu must be held.
+func (f *fakeConsul) agentChange() {
+	f.agentIndex++
+	close(f.agentChanged)
+	f.agentChanged = make(chan struct{})
+}
+
+// forget drops all the services and checks of the agent, as a restart of
+// the agent does.
+func (f *fakeConsul) forget() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.services = make(map[string]*consul_api.AgentServiceRegistration)
+	f.checks = make(map[string]string)
+	f.maintenance = make(map[string]bool)
+	f.agentChange()
+}
+
+// failRegister makes the registrations fail or succeed.
+func (f *fakeConsul) failRegister(fail bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.registerErr = fail
+}
+
+// service returns the registration of the service id on the agent, and how
+// many registrations the agent received.
+func (f *fakeConsul) service(id string) (*consul_api.AgentServiceRegistration, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.services[id], f.registrations
+}
+
+// check returns the status of the TTL check id.
+func (f *fakeConsul) check(id string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.checks[id]
+}
+
+// inMaintenance returns whether the service id is in maintenance.
+func (f *fakeConsul) inMaintenance(id string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.maintenance[id]
+}
+
+func (f *fakeConsul) serveAgent(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v1/agent/")
+	switch {
+	case path == "service/register":
+		var reg consul_api.AgentServiceRegistration
+		if err := json.NewDecoder(r.Body).Decode(&reg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.registrations++
+		if f.registerErr {
+			http.Error(w, "agent is unavailable", http.StatusInternalServerError)
+			return
+		}
+		id := reg.ID
+		if len(id) <= 0 {
+			id = reg.Name
+		}
+		f.services[id] = &reg
+		if reg.Check != nil && len(reg.Check.TTL) > 0 {
+			checkID := reg.Check.CheckID
+			if len(checkID) <= 0 {
+				checkID = "service:" + id
+			}
+			f.checks[checkID] = consul_api.HealthCritical
+		}
+		f.agentChange()
+	case strings.HasPrefix(path, "service/deregister/"):
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.services, strings.TrimPrefix(path, "service/deregister/"))
+		f.agentChange()
+	case strings.HasPrefix(path, "service/maintenance/"):
+		id := strings.TrimPrefix(path, "service/maintenance/")
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.services[id] == nil {
+			http.Error(w, "unknown service ID "+id, http.StatusNotFound)
+			return
+		}
+		f.maintenance[id] = r.URL.Query().Get("enable") == "true"
+	case strings.HasPrefix(path, "service/"):
+		id := strings.TrimPrefix(path, "service/")
+		hash, _ := strconv.ParseUint(r.URL.Query().Get("hash"), 10, 64)
+		f.mu.Lock()
+		if !f.wait(r, hash, &f.agentIndex, &f.agentChanged) {
+			return
+		}
+		defer f.mu.Unlock()
+		reg := f.services[id]
+		if reg == nil {
+			http.Error(w, "unknown service ID "+id, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("X-Consul-ContentHash", strconv.FormatUint(f.agentIndex, 10))
+		json.NewEncoder(w).Encode(&consul_api.AgentService{ID: id, Service: reg.Name, Address: reg.Address, Port: reg.Port})
+	case strings.HasPrefix(path, "check/update/"):
+		var update struct{ Status, Output string }
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		id := strings.TrimPrefix(path, "check/update/")
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if _, ok := f.checks[id]; !ok {
+			http.Error(w, "unknown check ID "+id, http.StatusInternalServerError)
+			return
+		}
+		f.checks[id] = update.Status
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/v1/health/service/"):
+		f.mu.Lock()
+		f.headers = append(f.headers, r.Header.Clone())
+		if !f.wait(r, index, &f.index, &f.changed) {
+			return
+		}
+		defer f.mu.Unlock()
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+		json.NewEncoder(w).Encode(f.entries)
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		f.mu.Lock()
+		if !f.wait(r, index, &f.configIndex, &f.configChanged) {
+			return
+		}
+		defer f.mu.Unlock()
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(f.configIndex, 10))
+		if f.config == nil || "/v1/kv/"+f.config.Key != r.URL.Path {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode([]*consul_api.KVPair{f.config})
+	case strings.HasPrefix(r.URL.Path, "/v1/agent/"):
+		f.serveAgent(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// wait blocks the query of index until *current grows past it, it is
+// called with f.mu held, and returns with f.mu held unless the query is
+// canceled.
+func (f *fakeConsul) wait(r *http.Request, index uint64, current *uint64, changed *chan struct{}) bool {
+	if index < *current {
+		return true
+	}
+	ch := *changed
+	f.mu.Unlock()
+	notify(f.blocking)
+	select {
+	case <-ch:
+	case <-r.Context().Done():
+		notify(f.canceled)
+		return false
+	}
+	f.mu.Lock()
+	return true
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (f *fakeConsul) requestHeaders() []http.Header {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]http.Header(nil), f.headers...)
+}
+
+func entry(id, addr string, port int) *consul_api.ServiceEntry {
+	return &consul_api.ServiceEntry{
+		Node:    &consul_api.Node{Address: "10.0.0.1"},
+		Service: &consul_api.AgentService{ID: id, Address: addr, Port: port},
+	}
+}
+
+// fakeClientConn records the states and errors of the resolver.
+type fakeClientConn struct {
+	resolver.ClientConn
+	states chan resolver.State
+	errs   chan error
+}
+
+func newFakeClientConn() *fakeClientConn {
+	return &fakeClientConn{
+		states: make(chan resolver.State, 10),
+		errs:   make(chan error, 1),
+	}
+}
+
+func (cc *fakeClientConn) UpdateState(s resolver.State) error {
+	cc.states <- s
+	return nil
+}
+
+func (cc *fakeClientConn) ReportError(err error) {
+	select {
+	case cc.errs <- err:
+	default:
+	}
+}
+
+func (cc *fakeClientConn) ParseServiceConfig(js string) *serviceconfig.ParseResult {
+	return &serviceconfig.ParseResult{Config: &fakeServiceConfig{js: js}}
+}
+
+type fakeServiceConfig struct {
+	serviceconfig.Config
+	js string
+}
+
+// next returns the next state of the resolver.
+func (cc *fakeClientConn) next(t *testing.T) resolver.State {
+	t.Helper()
+	select {
+	case s := <-cc.states:
+		return s
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the resolver state")
+	}
+	return resolver.State{}
+}
+
+func parseURL(t *testing.T, target string) resolver.Target {
+	t.Helper()
+	u, err := url.Parse(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resolver.Target{URL: *u}
+}
+
+func addrsOf(s resolver.State) []string {
+	addrs := make([]string, 0, len(s.Addresses))
+	for _, a := range s.Addresses {
+		addrs = append(addrs, a.Addr)
+	}
+	return addrs
+}
+
+func buildResolver(t *testing.T, srv *httptest.Server, query string) (resolver.Resolver, *fakeClientConn) {
+	t.Helper()
+	cc := newFakeClientConn()
+	host := strings.TrimPrefix(srv.URL, "http://")
+	r, err := NewBuilder().Build(parseURL(t, fmt.Sprintf("consul://%s/svc%s", host, query)), cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, cc
+}
+
+func TestResolverUpdates(t *testing.T) {
+	f := newFakeConsul()
+	f.set(entry("a", "127.0.0.1", 1), entry("b", "127.0.0.1", 2))
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	r, cc := buildResolver(t, srv, "")
+	defer r.Close()
+
+	for _, c := range []struct {
+		name    string
+		entries []*consul_api.ServiceEntry
+		want    []string
+	}{
+		{"initial", nil, []string{"127.0.0.1:1", "127.0.0.1:2"}},
+		{"add", []*consul_api.ServiceEntry{entry("a", "127.0.0.1", 1), entry("b", "127.0.0.1", 2), entry("c", "127.0.0.1", 3)},
+			[]string{"127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3"}},
+		{"remove", []*consul_api.ServiceEntry{entry("c", "127.0.0.1", 3)}, []string{"127.0.0.1:3"}},
+		{"node address", []*consul_api.ServiceEntry{entry("c", "", 3)}, []string{"10.0.0.1:3"}},
+		{"all gone", []*consul_api.ServiceEntry{}, []string{}},
+	} {
+		if c.entries != nil {
+			f.set(c.entries...)
+		}
+		if got := addrsOf(cc.next(t)); fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Errorf("%s: addresses %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestResolverClose(t *testing.T) {
+	f := newFakeConsul()
+	f.set(entry("a", "127.0.0.1", 1))
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	r, cc := buildResolver(t, srv, "")
+	cc.next(t)
+	select {
+	case <-f.blocking:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the blocking query")
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		r.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close didn't return while the blocking query was in flight")
+	}
+	select {
+	case <-f.canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the blocking query was not canceled")
+	}
+
+	// Close waits for the watcher, which sends no more queries
+	n := len(f.requestHeaders())
+	f.set(entry("b", "127.0.0.1", 2))
+	time.Sleep(100 * time.Millisecond)
+	if m := len(f.requestHeaders()); m != n {
+		t.Errorf("%d queries after Close", m-n)
+	}
+	select {
+	case s := <-cc.states:
+		t.Errorf("state %v after Close", s)
+	default:
+	}
+}
+
+func TestResolverServiceConfig(t *testing.T) {
+	f := newFakeConsul()
+	f.set(entry("a", "127.0.0.1", 1))
+	f.setConfig("svc/config", `{"loadBalancingPolicy": "robin"}`)
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	r, cc := buildResolver(t, srv, "?config_key=svc/config")
+	defer r.Close()
+
+	configOf := func(s resolver.State) string {
+		if s.ServiceConfig == nil {
+			return ""
+		}
+		return s.ServiceConfig.Config.(*fakeServiceConfig).js
+	}
+	for _, c := range []struct {
+		name   string
+		change func()
+		config string
+		addrs  []string
+	}{
+		{"initial", func() {}, `{"loadBalancingPolicy": "robin"}`, []string{"127.0.0.1:1"}},
+		// only the key changes, the service doesn't
+		{"config", func() { f.setConfig("svc/config", `{"loadBalancingPolicy": "random"}`) },
+			`{"loadBalancingPolicy": "random"}`, []string{"127.0.0.1:1"}},
+		{"service", func() { f.set(entry("a", "127.0.0.1", 1), entry("b", "127.0.0.1", 2)) },
+			`{"loadBalancingPolicy": "random"}`, []string{"127.0.0.1:1", "127.0.0.1:2"}},
+		{"config removed", func() { f.setConfig("svc/other", `{}`) }, "", []string{"127.0.0.1:1", "127.0.0.1:2"}},
+	} {
+		c.change()
+		s := cc.next(t)
+		if got := configOf(s); got != c.config {
+			t.Errorf("%s: service config %q, want %q", c.name, got, c.config)
+		}
+		if got := addrsOf(s); fmt.Sprint(got) != fmt.Sprint(c.addrs) {
+			t.Errorf("%s: addresses %v, want %v", c.name, got, c.addrs)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package consul
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	consul_api "github.com/hashicorp/consul/api"
+	"google.golang.org/grpc/resolver"
+)
+
+// consulTarget is the parsed form of a consul target, such as
+// consul://agent:8500/service?dc=eu1&tag=canary or
+// consul:///agent:8500/service?dc=eu1&tag=canary&scheme=https&ca_file=ca.pem
+type consulTarget struct {
+	addr    string
+	service string
+	tags    []string
+	passing bool
+	query   consul_api.QueryOptions
+	client  ClientConfig
+	// configKey is the key of the service config in the consul KV.
+	configKey string
+}
+
+// parseTarget parses the target, the client settings in the query override
+// the ones of the builder.
+func parseTarget(target resolver.Target, client ClientConfig) (*consulTarget, error) {
+	endpoint, rawQuery := target.Endpoint(), target.URL.RawQuery
+
+	t := &consulTarget{
+		passing: true,
+		client:  client,
+	}
+	if len(target.URL.Host) > 0 {
+		t.addr, t.service = target.URL.Host, endpoint
+	} else if ss := strings.SplitN(endpoint, "/", 2); len(ss) >= 2 {
+		t.addr, t.service = ss[0], ss[1]
+	} else {
+		t.addr = endpoint
+	}
+	if len(t.service) == 0 {
+		return nil, fmt.Errorf("consul: no service in target %q", target.URL.String())
+	}
+
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("consul: invalid target query %q: %v", rawQuery, err)
+	}
+	for k, vs := range values {
+		v := vs[len(vs)-1]
+		switch k {
+		case "dc":
+			t.query.Datacenter = v
+		case "tag":
+			t.tags = vs
+		case "near":
+			t.query.Near = v
+		case "ns":
+			t.query.Namespace = v
+		case "partition":
+			t.query.Partition = v
+		case "stale":
+			if t.query.AllowStale, err = strconv.ParseBool(v); err != nil {
+				return nil, fmt.Errorf("consul: invalid target parameter stale=%q: %v", v, err)
+			}
+		case "passing":
+			if t.passing, err = strconv.ParseBool(v); err != nil {
+				return nil, fmt.Errorf("consul: invalid target parameter passing=%q: %v", v, err)
+			}
+		case "config_key":
+			t.configKey = v
+		case "wait":
+			if t.query.WaitTime, err = time.ParseDuration(v); err != nil {
+				return nil, fmt.Errorf("consul: invalid target parameter wait=%q: %v", v, err)
+			}
+		case "scheme":
+			t.client.Scheme = v
+		case "token":
+			t.client.Token = v
+		case "token_file":
+			t.client.TokenFile = v
+		case "http_auth":
+			auth := &consul_api.HttpBasicAuth{Username: v}
+			if i := strings.IndexByte(v, ':'); i >= 0 {
+				auth.Username, auth.Password = v[:i], v[i+1:]
+			}
+			t.client.HttpAuth = auth
+		case "ca_file":
+			t.client.TLS.CAFile = v
+		case "ca_path":
+			t.client.TLS.CAPath = v
+		case "cert_file":
+			t.client.TLS.CertFile = v
+		case "key_file":
+			t.client.TLS.KeyFile = v
+		case "tls_server_name":
+			t.client.TLS.Address = v
+		case "tls_skip_verify":
+			skip, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("consul: invalid target parameter tls_skip_verify=%q: %v", v, err)
+			}
+			t.client.skipVerify = &skip
+		default:
+			return nil, fmt.Errorf("consul: unknown target parameter %q", k)
+		}
+	}
+
+	return t, nil
+}
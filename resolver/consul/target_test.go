@@ -0,0 +1,77 @@
+package consul
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	consul_api "github.com/hashicorp/consul/api"
+)
+
+func TestParseTarget(t *testing.T) {
+	for _, c := range []struct {
+		target  string
+		addr    string
+		service string
+	}{
+		{"consul://agent:8500/svc", "agent:8500", "svc"},
+		{"consul:///agent:8500/svc", "agent:8500", "svc"},
+		{"consul://agent:8500/svc?dc=eu1&tag=canary", "agent:8500", "svc"},
+	} {
+		ct, err := parseTarget(parseURL(t, c.target), ClientConfig{})
+		if err != nil {
+			t.Errorf("parseTarget(%q): %v", c.target, err)
+			continue
+		}
+		if ct.addr != c.addr || ct.service != c.service {
+			t.Errorf("parseTarget(%q) = %q, %q, want %q, %q", c.target, ct.addr, ct.service, c.addr, c.service)
+		}
+	}
+
+	for _, target := range []string{
+		"consul://agent:8500/",
+		"consul:///agent:8500",
+		"consul:///agent:8500/",
+		"consul://agent:8500/svc?bogus=1",
+		"consul://agent:8500/svc?stale=maybe",
+		"consul://agent:8500/svc?passing=maybe",
+		"consul://agent:8500/svc?wait=soon",
+	} {
+		if _, err := parseTarget(parseURL(t, target), ClientConfig{}); err == nil {
+			t.Errorf("parseTarget(%q) succeeded, want an error", target)
+		}
+	}
+}
+
+func TestParseTargetQuery(t *testing.T) {
+	for _, c := range []struct {
+		query   string
+		tags    []string
+		passing bool
+		want    consul_api.QueryOptions
+	}{
+		{"", nil, true, consul_api.QueryOptions{}},
+		{"?dc=eu1&near=_agent&ns=team&partition=part", nil, true,
+			consul_api.QueryOptions{Datacenter: "eu1", Near: "_agent", Namespace: "team", Partition: "part"}},
+		{"?tag=canary&tag=v2", []string{"canary", "v2"}, true, consul_api.QueryOptions{}},
+		{"?stale=true&wait=30s&passing=false", nil, false, consul_api.QueryOptions{AllowStale: true, WaitTime: 30 * time.Second}},
+		// the last one of a repeated parameter wins
+		{"?dc=eu1&dc=us1&passing=0&passing=1", nil, true, consul_api.QueryOptions{Datacenter: "us1"}},
+	} {
+		target := "consul://agent:8500/svc" + c.query
+		ct, err := parseTarget(parseURL(t, target), ClientConfig{})
+		if err != nil {
+			t.Errorf("parseTarget(%q): %v", target, err)
+			continue
+		}
+		if !reflect.DeepEqual(ct.tags, c.tags) {
+			t.Errorf("parseTarget(%q): tags %q, want %q", target, ct.tags, c.tags)
+		}
+		if ct.passing != c.passing {
+			t.Errorf("parseTarget(%q): passing %v, want %v", target, ct.passing, c.passing)
+		}
+		if !reflect.DeepEqual(ct.query, c.want) {
+			t.Errorf("parseTarget(%q): query %+v, want %+v", target, ct.query, c.want)
+		}
+	}
+}